@@ -0,0 +1,281 @@
+package proxy_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ACL decides which targets the ss sessions may connect to. A rule is
+// written as:
+//
+//	allow|deny target [ports]
+//
+// the target is one of
+//
+//	10.0.0.0/8     a cidr, or a single ip
+//	example.com    the domain only
+//	.example.com   the domain and its subdomains
+//	*.example.com  the subdomains only
+//	*              any target
+//
+// and the ports a list like 80,443,8000-8999, any port if omitted. The
+// first rule matching a target decides, the default action otherwise.
+type ACL struct {
+	rules []aclRule
+	// allow the targets no rule matches
+	allow bool
+}
+
+// DenyPrivateRules deny the loopback, private, link-local, multicast,
+// reserved and other special networks, e.g. the cloud metadata
+// addresses, and the nat64 prefixes reaching them.
+var DenyPrivateRules = []string{
+	"deny 0.0.0.0/8",
+	"deny 10.0.0.0/8",
+	"deny 100.64.0.0/10",
+	"deny 127.0.0.0/8",
+	"deny 169.254.0.0/16",
+	"deny 172.16.0.0/12",
+	"deny 192.0.0.0/24",
+	"deny 192.168.0.0/16",
+	"deny 198.18.0.0/15",
+	"deny 224.0.0.0/4",
+	"deny 240.0.0.0/4",
+	"deny ::/128",
+	"deny ::1/128",
+	"deny 64:ff9b::/96",
+	"deny 64:ff9b:1::/48",
+	"deny 100::/64",
+	"deny 2001::/23",
+	"deny fc00::/7",
+	"deny fe80::/10",
+	"deny fec0::/10",
+	"deny ff00::/8",
+}
+
+var (
+	badACLRuleErr = errors.New("malformed acl rule")
+	aclDeniedErr  = errors.New("target is denied by acl")
+)
+
+type aclRule struct {
+	text  string
+	allow bool
+
+	any    bool
+	ipNet  *net.IPNet
+	domain string
+	// domain matches the subdomains, and itself if self
+	suffix bool
+	self   bool
+
+	// empty is any port
+	ports []portRange
+}
+
+type portRange struct {
+	from, to int
+}
+
+// NewACL parses rules, in order, defaultAction is "allow" or "deny",
+// empty means "allow".
+func NewACL(rules []string, defaultAction string) (*ACL, error) {
+	a := &ACL{allow: true}
+	switch defaultAction {
+	case "", "allow":
+	case "deny":
+		a.allow = false
+	default:
+		aclLog.Error("bad default action", "action", defaultAction)
+		return nil, badACLRuleErr
+	}
+	for _, text := range rules {
+		r, err := parseACLRule(text)
+		if err != nil {
+			aclLog.Error("bad rule", "rule", text)
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+func parseACLRule(text string) (aclRule, error) {
+	r := aclRule{text: text}
+	fields := strings.Fields(text)
+	if len(fields) != 2 && len(fields) != 3 {
+		return r, badACLRuleErr
+	}
+
+	switch fields[0] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, badACLRuleErr
+	}
+
+	target := strings.ToLower(fields[1])
+	switch {
+	case target == "*":
+		r.any = true
+	case strings.Contains(target, "/"):
+		_, n, err := net.ParseCIDR(target)
+		if err != nil {
+			return r, badACLRuleErr
+		}
+		r.ipNet = n
+	case net.ParseIP(target) != nil:
+		ip := net.ParseIP(target)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(target, "*."):
+		r.domain, r.suffix = target[2:], true
+	case strings.HasPrefix(target, "."):
+		r.domain, r.suffix, r.self = target[1:], true, true
+	default:
+		r.domain, r.self = target, true
+	}
+	if r.domain != "" && strings.ContainsAny(r.domain, "*/") {
+		return r, badACLRuleErr
+	}
+
+	if len(fields) == 3 {
+		for _, p := range strings.Split(fields[2], ",") {
+			pr, err := parsePortRange(p)
+			if err != nil {
+				return r, err
+			}
+			r.ports = append(r.ports, pr)
+		}
+	}
+	return r, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	f, err1 := strconv.Atoi(from)
+	t, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || f < 1 || t > 65535 || f > t {
+		return portRange{}, badACLRuleErr
+	}
+	return portRange{f, t}, nil
+}
+
+func (r *aclRule) match(domain string, ip net.IP, port int) bool {
+	if len(r.ports) > 0 {
+		in := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+
+	switch {
+	case r.any:
+		return true
+	case r.ipNet != nil:
+		return ip != nil && r.ipNet.Contains(ip)
+	case domain == "":
+		return false
+	case r.self && domain == r.domain:
+		return true
+	default:
+		return r.suffix && strings.HasSuffix(domain, "."+r.domain)
+	}
+}
+
+// Allow reports whether a target may be connected to and the rule
+// deciding it, "default" if none matches. domain is the one requested,
+// empty for an ip, and ip is what it resolves to.
+func (a *ACL) Allow(domain string, ip net.IP, port int) (bool, string) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for i := range a.rules {
+		if r := &a.rules[i]; r.match(domain, ip, port) {
+			return r.allow, r.text
+		}
+	}
+	return a.allow, "default"
+}
+
+// allowTarget is Allow logging and counting the denied targets, a nil
+// acl allows any.
+func (a *ACL) allowTarget(l Logger, domain string, ip net.IP, port int) bool {
+	if a == nil {
+		return true
+	}
+	ok, rule := a.Allow(domain, ip, port)
+	if !ok {
+		aclDenied.add(1, "rule", rule)
+		l.Info("target denied", "ip", ip, "rule", rule)
+	}
+	return ok
+}
+
+// WithACL makes the ss sessions of the server only connect to the
+// targets allowed by acl.
+func WithACL(acl *ACL) ServerOption {
+	return func(s *srv) error {
+		s.acl = acl
+		return nil
+	}
+}
+
+// dialTarget connects to host on network, host is the host:port of a
+// ss request. With an acl or a resolver of p, a domain is resolved first
+// and only the addresses allowed by the acl are dialed, in order.
+func dialTarget(l Logger, p sessionPolicy, network, host string) (net.Conn, error) {
+	if p.acl == nil && p.resolver == nil {
+		return net.Dial(network, host)
+	}
+
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		domain string
+		ips    []net.IP
+	)
+	if ip := net.ParseIP(h); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		domain = h
+		if ips, err = p.resolver.LookupIP(context.Background(), h); err != nil {
+			return nil, err
+		}
+	}
+
+	err = aclDeniedErr
+	for _, ip := range ips {
+		if !p.acl.allowTarget(l, domain, ip, portNum) {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = net.Dial(network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,147 @@
+package proxy_server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewACL(t *testing.T) {
+	for name, c := range map[string]struct {
+		rules  []string
+		def    string
+		expect error
+	}{
+		"valid": {
+			rules: []string{"deny 10.0.0.0/8", "allow *.example.com 80,443,8000-8999", "deny ::1", "allow * 53"},
+			def:   "deny",
+		},
+		"badAction":  {rules: []string{"drop 10.0.0.0/8"}, expect: badACLRuleErr},
+		"badCIDR":    {rules: []string{"deny 10.0.0.0/33"}, expect: badACLRuleErr},
+		"badPort":    {rules: []string{"deny * 0"}, expect: badACLRuleErr},
+		"badRange":   {rules: []string{"deny * 90-80"}, expect: badACLRuleErr},
+		"badDomain":  {rules: []string{"deny a.*.com"}, expect: badACLRuleErr},
+		"tooLong":    {rules: []string{"deny * 80 443"}, expect: badACLRuleErr},
+		"badDefault": {def: "drop", expect: badACLRuleErr},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := NewACL(c.rules, c.def); err != c.expect {
+				t.Errorf("expect error %v, but got %v", c.expect, err)
+			}
+		})
+	}
+}
+
+func TestACLAllow(t *testing.T) {
+	acl, err := NewACL(append([]string{
+		"allow 10.1.2.3 443",
+		"deny *.internal.example.com",
+		"allow .example.com 80,443",
+		"deny example.org",
+		"deny * 25",
+	}, DenyPrivateRules...), "allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]struct {
+		domain string
+		ip     string
+		port   int
+		allow  bool
+		rule   string
+	}{
+		"public":           {ip: "1.1.1.1", port: 443, allow: true, rule: "default"},
+		"loopback":         {ip: "127.0.0.1", port: 80, rule: "deny 127.0.0.0/8"},
+		"loopbackV6":       {ip: "::1", port: 80, rule: "deny ::1/128"},
+		"mappedV4":         {ip: "::ffff:192.168.1.1", port: 80, rule: "deny 192.168.0.0/16"},
+		"metadata":         {ip: "169.254.169.254", port: 80, rule: "deny 169.254.0.0/16"},
+		"metadataV6":       {ip: "fd00:ec2::254", port: 80, rule: "deny fc00::/7"},
+		"ietf":             {ip: "192.0.0.170", port: 80, rule: "deny 192.0.0.0/24"},
+		"benchmark":        {ip: "198.19.0.1", port: 80, rule: "deny 198.18.0.0/15"},
+		"multicast":        {ip: "239.255.255.250", port: 1900, rule: "deny 224.0.0.0/4"},
+		"broadcast":        {ip: "255.255.255.255", port: 67, rule: "deny 240.0.0.0/4"},
+		"multicastV6":      {ip: "ff02::1", port: 80, rule: "deny ff00::/8"},
+		"nat64":            {ip: "64:ff9b::a00:1", port: 80, rule: "deny 64:ff9b::/96"},
+		"allowedPrivate":   {ip: "10.1.2.3", port: 443, allow: true, rule: "allow 10.1.2.3 443"},
+		"privateOtherPort": {ip: "10.1.2.3", port: 22, rule: "deny 10.0.0.0/8"},
+		"smtp":             {ip: "1.1.1.1", port: 25, rule: "deny * 25"},
+		"wildcard":         {domain: "a.internal.example.com", ip: "1.1.1.1", port: 80, rule: "deny *.internal.example.com"},
+		"wildcardSelf":     {domain: "internal.example.com", ip: "1.1.1.1", port: 80, allow: true, rule: "allow .example.com 80,443"},
+		"suffix":           {domain: "WWW.Example.com.", ip: "1.1.1.1", port: 443, allow: true, rule: "allow .example.com 80,443"},
+		"suffixPort":       {domain: "www.example.com", ip: "1.1.1.1", port: 8080, allow: true, rule: "default"},
+		"suffixPrivate":    {domain: "www.example.com", ip: "10.0.0.1", port: 22, rule: "deny 10.0.0.0/8"},
+		"exact":            {domain: "example.org", ip: "1.1.1.1", port: 443, rule: "deny example.org"},
+		"exactSub":         {domain: "www.example.org", ip: "1.1.1.1", port: 443, allow: true, rule: "default"},
+		"domainToPrivate":  {domain: "evil.test", ip: "192.168.1.1", port: 80, rule: "deny 192.168.0.0/16"},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			allow, rule := acl.Allow(c.domain, net.ParseIP(c.ip), c.port)
+			if allow != c.allow || rule != c.rule {
+				t.Errorf("expect %t by %q, but got %t by %q", c.allow, c.rule, allow, rule)
+			}
+		})
+	}
+}
+
+func TestDialTarget(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	deny, err := NewACL(DenyPrivateRules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow, err := NewACL([]string{"allow 127.0.0.1 " + port}, "deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]struct {
+		acl  *ACL
+		host string
+		err  error
+	}{
+		"noACL":  {host: "127.0.0.1:" + port},
+		"ip":     {acl: deny, host: "127.0.0.1:" + port, err: aclDeniedErr},
+		"domain": {acl: deny, host: "localhost:" + port, err: aclDeniedErr},
+		"allow":  {acl: allow, host: "127.0.0.1:" + port},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			conn, err := dialTarget(NewLogger(&b, LevelInfo, TextFormat), sessionPolicy{acl: c.acl},
+				"tcp", c.host)
+			if err != c.err {
+				t.Fatalf("expect error %v, but got %v", c.err, err)
+			}
+			if err != nil {
+				if !strings.Contains(b.String(), "target denied") || !strings.Contains(b.String(), "rule=") {
+					t.Errorf("denied target is not logged with its rule: %q", b.String())
+				}
+				return
+			}
+			conn.Close()
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package proxy_server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// An aead session follows the shadowsocks AEAD construction: each
+// direction starts with a random salt, the session key is derived from
+// the master key and the salt with HKDF-SHA1, then the stream is a
+// sequence of chunks:
+// [encrypted payload length][length tag][encrypted payload][payload tag]
+// the nonce is a little endian counter which is increased after each
+// seal or open.
+
+const aeadMaxPayload = 0x3fff
+
+var (
+	aeadSubkeyInfo = []byte("ss-subkey")
+
+	emptyPasswordErr = errors.New("empty password")
+)
+
+type aeadMethod struct {
+	keyLen  int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var aeadMethods = map[string]aeadMethod{
+	"aes-128-gcm":            {16, newGCM},
+	"aes-192-gcm":            {24, newGCM},
+	"aes-256-gcm":            {32, newGCM},
+	"chacha20-ietf-poly1305": {chacha20poly1305.KeySize, chacha20poly1305.New},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type aeadCipher struct {
+	method     aeadMethod
+	key        []byte
+	saltReader io.Reader
+}
+
+func newAEADCipher(method, password string) (*aeadCipher, error) {
+	m, ok := aeadMethods[method]
+	if !ok {
+		return nil, errors.New("unsupported aead method: " + method)
+	}
+	if password == "" {
+		return nil, emptyPasswordErr
+	}
+	return &aeadCipher{
+		method:     m,
+		key:        evpBytesToKey(password, m.keyLen),
+		saltReader: rand.Reader,
+	}, nil
+}
+
+func (c *aeadCipher) newConn(conn net.Conn) net.Conn {
+	return &aeadConn{Conn: conn, cipher: c}
+}
+
+func (c *aeadCipher) saltSize() int {
+	if c.method.keyLen > 16 {
+		return c.method.keyLen
+	}
+	return 16
+}
+
+func (c *aeadCipher) session(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.method.keyLen)
+	r := hkdf.New(sha1.New, c.key, salt, aeadSubkeyInfo)
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		return nil, err
+	}
+	return c.method.newAEAD(subkey)
+}
+
+// aeadConn encrypts and decrypts a data connection with an aead cipher.
+type aeadConn struct {
+	net.Conn
+	cipher *aeadCipher
+
+	dec      cipher.AEAD
+	rnonce   []byte
+	rbuf     []byte
+	leftover []byte
+
+	enc    cipher.AEAD
+	wnonce []byte
+}
+
+func (c *aeadConn) Read(b []byte) (int, error) {
+	for len(c.leftover) == 0 {
+		if c.dec == nil {
+			salt := make([]byte, c.cipher.saltSize())
+			if _, err := io.ReadFull(c.Conn, salt); err != nil {
+				return 0, err
+			}
+			dec, err := c.cipher.session(salt)
+			if err != nil {
+				return 0, err
+			}
+			c.dec = dec
+			c.rnonce = make([]byte, dec.NonceSize())
+			c.rbuf = make([]byte, aeadMaxPayload+dec.Overhead())
+		}
+		payload, err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		c.leftover = payload
+	}
+
+	n := copy(b, c.leftover)
+	c.leftover = c.leftover[n:]
+	return n, nil
+}
+
+func (c *aeadConn) readChunk() ([]byte, error) {
+	overhead := c.dec.Overhead()
+
+	b := c.rbuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, b); err != nil {
+		return nil, err
+	}
+	if _, err := c.dec.Open(b[:0], c.rnonce, b, nil); err != nil {
+		return nil, err
+	}
+	increaseNonce(c.rnonce)
+
+	size := int(binary.BigEndian.Uint16(b)) & aeadMaxPayload
+	b = c.rbuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, b); err != nil {
+		return nil, err
+	}
+	if _, err := c.dec.Open(b[:0], c.rnonce, b, nil); err != nil {
+		return nil, err
+	}
+	increaseNonce(c.rnonce)
+
+	return b[:size], nil
+}
+
+func (c *aeadConn) Write(b []byte) (int, error) {
+	var out []byte
+	if c.enc == nil {
+		salt := make([]byte, c.cipher.saltSize())
+		if _, err := io.ReadFull(c.cipher.saltReader, salt); err != nil {
+			return 0, err
+		}
+		enc, err := c.cipher.session(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc = enc
+		c.wnonce = make([]byte, enc.NonceSize())
+		out = salt
+	}
+
+	var size [2]byte
+	for p := b; len(p) > 0; {
+		n := len(p)
+		if n > aeadMaxPayload {
+			n = aeadMaxPayload
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(n))
+		out = c.enc.Seal(out, c.wnonce, size[:], nil)
+		increaseNonce(c.wnonce)
+		out = c.enc.Seal(out, c.wnonce, p[:n], nil)
+		increaseNonce(c.wnonce)
+		p = p[n:]
+	}
+
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// increaseNonce treats nonce as a little endian number and adds one.
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// evpBytesToKey is the key derivation of the original shadowsocks,
+// it mimics EVP_BytesToKey of openssl with md5 and no salt.
+func evpBytesToKey(password string, keyLen int) []byte {
+	var (
+		key  []byte
+		prev []byte
+	)
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
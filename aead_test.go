@@ -0,0 +1,251 @@
+package proxy_server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// vectors are encrypted with password "foobar" and salt 00 01 02 ...,
+// they are checked against go-shadowsocks2 in both directions.
+var aeadVectors = map[string]struct {
+	key, ciphertext string
+}{
+	"aes-128-gcm": {
+		key: "3858f62230ac3c915f300c664312c63f",
+		ciphertext: "000102030405060708090a0b0c0d0e0f" +
+			"f8424075e0216eed27e65e0fe3d04b430a55" +
+			"5761c1b6239b19ee4c76575539833d7af23071e7936db60dfd47e925",
+	},
+	"aes-256-gcm": {
+		key: "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf",
+		ciphertext: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+			"26f0c5edea3c39fa5f3dcd5f0d9760910b63" +
+			"4f761ca4426c89095bbe8dd358a8ed353d1e14e5947e9639b7cd1ddc",
+	},
+	"chacha20-ietf-poly1305": {
+		key: "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf",
+		ciphertext: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+			"5d9bfa40e3e8c4f766b44555586ae806ab8a" +
+			"c7e7dd301fd5cfe427b4aae920b65a48705a4328260d1b9c1223953a",
+	},
+}
+
+const aeadPlaintext = "hello, world"
+
+type bufConn struct {
+	net.Conn
+	b bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.b.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.b.Write(p) }
+
+func seqSalt(n int) io.Reader {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return bytes.NewReader(b)
+}
+
+func TestAEADEncrypt(t *testing.T) {
+	for method, v := range aeadVectors {
+		method, v := method, v
+		t.Run(method, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := newAEADCipher(method, "foobar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(c.key); got != v.key {
+				t.Errorf("expect key %s, but got %s", v.key, got)
+			}
+			c.saltReader = seqSalt(c.saltSize())
+
+			var b bufConn
+			n, err := c.newConn(&b).Write([]byte(aeadPlaintext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(aeadPlaintext) {
+				t.Errorf("expect write %d bytes, but got %d", len(aeadPlaintext), n)
+			}
+			if got := hex.EncodeToString(b.b.Bytes()); got != v.ciphertext {
+				t.Errorf("expect ciphertext %s, but got %s", v.ciphertext, got)
+			}
+		})
+	}
+}
+
+func TestAEADDecrypt(t *testing.T) {
+	for method, v := range aeadVectors {
+		method, v := method, v
+		t.Run(method, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := newAEADCipher(method, "foobar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct, err := hex.DecodeString(v.ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bufConn
+			b.b.Write(ct)
+			got, err := ioutil.ReadAll(c.newConn(&b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != aeadPlaintext {
+				t.Errorf("expect plaintext %q, but got %q", aeadPlaintext, got)
+			}
+
+			// tamper the payload
+			ct[len(ct)-1] ^= 0xff
+			b.b.Reset()
+			b.b.Write(ct)
+			if _, err = ioutil.ReadAll(c.newConn(&b)); err == nil {
+				t.Error("not get expected authentication error")
+			}
+
+			// wrong password
+			c, err = newAEADCipher(method, "barfoo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct[len(ct)-1] ^= 0xff
+			b.b.Reset()
+			b.b.Write(ct)
+			if _, err = ioutil.ReadAll(c.newConn(&b)); err == nil {
+				t.Error("not get expected authentication error")
+			}
+		})
+	}
+}
+
+func TestIncreaseNonce(t *testing.T) {
+	for name, c := range map[string]struct {
+		nonce, expect []byte
+	}{
+		"zero":  {[]byte{0, 0, 0}, []byte{1, 0, 0}},
+		"carry": {[]byte{0xff, 0xff, 0}, []byte{0, 0, 1}},
+		"wrap":  {[]byte{0xff, 0xff, 0xff}, []byte{0, 0, 0}},
+	} {
+		increaseNonce(c.nonce)
+		if !bytes.Equal(c.nonce, c.expect) {
+			t.Errorf("%s: expect %v, but got %v", name, c.expect, c.nonce)
+		}
+	}
+}
+
+func TestAEADLargePayload(t *testing.T) {
+	c, err := newAEADCipher("chacha20-ietf-poly1305", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	w, r := c.newConn(c1), c.newConn(c2)
+
+	data := make([]byte, 3*aeadMaxPayload+1)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("got data not equal to what we write")
+	}
+}
+
+func TestNewSSCipher(t *testing.T) {
+	for name, c := range map[string]struct {
+		method, password string
+		shouldErr        bool
+		aead             bool
+	}{
+		"default":      {password: "foo"},
+		"stream":       {method: "aes-256-cfb", password: "foo"},
+		"aead":         {method: "aes-256-gcm", password: "foo", aead: true},
+		"badMethod":    {method: "foo", password: "foo", shouldErr: true},
+		"aeadNoPass":   {method: "chacha20-ietf-poly1305", shouldErr: true},
+		"streamNoPass": {method: "aes-256-cfb", shouldErr: true},
+	} {
+		got, err := newSSCipher(c.method, c.password)
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%s: expect error %v, but got %v", name, c.shouldErr, err)
+			continue
+		}
+		if c.shouldErr {
+			continue
+		}
+		if _, ok := got.(*aeadCipher); ok != c.aead {
+			t.Errorf("%s: expect aead %v, but got %T", name, c.aead, got)
+		}
+	}
+}
+
+func TestHandleSSConnectionAEAD(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		// echo
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	c, err := newSSCipher("aes-256-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	sc1, sc2 := c.newConn(c1), c.newConn(c2)
+
+	done := make(chan struct{})
+	go func() {
+		handleSSConnection(ssLog, sc1, false, sessionPolicy{})
+		close(done)
+	}()
+
+	req, err := translateIpv4(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sc2.Write(append(req, aeadPlaintext...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(aeadPlaintext))
+	_, err = io.ReadFull(sc2, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != aeadPlaintext {
+		t.Errorf("got[%s] not our expected[%s]", got, aeadPlaintext)
+	}
+
+	sc2.Close()
+	<-done
+}
@@ -1,6 +1,106 @@
 package proxy_server
 
-func agent() {
-	// todo
-	Debug.Printf("[agent]: agent mode start\n")
+import (
+	"context"
+	"time"
+)
+
+var (
+	agentMinBackoff      = 1 * time.Second
+	agentMaxBackoff      = 1 * time.Minute
+	agentShutdownTimeout = 10 * time.Second
+)
+
+// AddressFunc returns the plugin, control and data addresses of a
+// server, it is called every time the agent (re)starts one.
+type AddressFunc func() (plugin, control, data string, err error)
+
+type agent struct {
+	addrs AddressFunc
+	opts  []ServerOption
+}
+
+// NewAgent returns a supervisor which keeps a server created with opts
+// running on the addresses returned by addrs.
+func NewAgent(addrs AddressFunc, opts ...ServerOption) *agent {
+	return &agent{
+		addrs: addrs,
+		opts:  opts,
+	}
+}
+
+// Run starts a server and restarts it with an exponential backoff
+// whenever it fails, until ctx is done or the plugin asks to exit.
+func (a *agent) Run(ctx context.Context) error {
+	agentLog.Debug("agent mode start")
+
+	backoff := agentMinBackoff
+	for {
+		start := time.Now()
+		err := a.runOnce(ctx)
+		if ctx.Err() != nil {
+			agentLog.Debug("agent mode exit", "err", ctx.Err())
+			return nil
+		}
+		if err == nil || err == pluginExitErr {
+			agentLog.Debug("server exits", "err", err)
+			return nil
+		}
+
+		// a server which has been running for a while is healthy,
+		// start over from the minimal backoff
+		if time.Since(start) > agentMaxBackoff {
+			backoff = agentMinBackoff
+		}
+		agentLog.Error("server failed, restart", "err", err, "backoff", backoff)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			agentLog.Debug("agent mode exit", "err", ctx.Err())
+			return nil
+		case <-t.C:
+		}
+
+		backoff *= 2
+		if backoff > agentMaxBackoff {
+			backoff = agentMaxBackoff
+		}
+	}
+}
+
+func (a *agent) runOnce(ctx context.Context) error {
+	p, c, d, err := a.addrs()
+	if err != nil {
+		return err
+	}
+
+	s, err := NewServer(p, c, d, a.opts...)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		a.shutdown(s)
+	}()
+
+	err = s.Loop()
+	close(done)
+	return err
+}
+
+func (a *agent) shutdown(s *srv) {
+	ctx, cancel := context.WithTimeout(context.Background(), agentShutdownTimeout)
+	defer cancel()
+
+	err := s.Shutdown(ctx)
+	if err != nil && err != shutdownErr {
+		agentLog.Error("shutdown server failed", "err", err)
+	}
 }
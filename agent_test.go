@@ -0,0 +1,109 @@
+package proxy_server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAgentRestart(t *testing.T) {
+	agentMinBackoff = 1 * time.Millisecond
+	agentMaxBackoff = 4 * time.Millisecond
+
+	// plugin which drops every connection, so the server fails at once
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const expectCalls = 5
+	calls := 0
+	a := NewAgent(func() (string, string, string, error) {
+		calls++
+		switch {
+		case calls == 1:
+			return "", "", "", errors.New("no vm address")
+		case calls == expectCalls:
+			cancel()
+		}
+		return l.Addr().String(), "", "", nil
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("got unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent doesn't exit")
+	}
+	if calls != expectCalls {
+		t.Errorf("expect %d calls, but got %d", expectCalls, calls)
+	}
+}
+
+func TestAgentPluginExit(t *testing.T) {
+	agentMinBackoff = 1 * time.Millisecond
+	agentMaxBackoff = 4 * time.Millisecond
+
+	// plugin which asks the server to exit
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		WriteTLV(conn, TLV{T: pExit, L: 0, V: []byte{}})
+		// wait for the server to close us, past its announcement
+		io.Copy(io.Discard, conn)
+	}()
+
+	calls := 0
+	a := NewAgent(func() (string, string, string, error) {
+		calls++
+		return l.Addr().String(), "", "", nil
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(context.Background())
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("got unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent doesn't exit")
+	}
+	if calls != 1 {
+		t.Errorf("server should not be restarted, but got %d calls", calls)
+	}
+}
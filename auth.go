@@ -0,0 +1,166 @@
+package proxy_server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// The control tunnel handshake, done before any other TLV:
+//
+//	server -> peer: tHello V = version(2) | server nonce(16) | server id
+//	peer -> server: tHello V = version(2) | peer nonce(16) | peer mac(32)
+//	server -> peer: tAuth  V = server mac(32)
+//
+// Both macs are HMAC-SHA256 of the two nonces and the server id keyed
+// by the shared secret, each side proves it with a different label so
+// that a mac can't be reflected.
+const (
+	tHello = 6
+	tAuth  = 7
+
+	ProtocolVersion = 1
+
+	nonceLen   = 16
+	lenVersion = 2
+
+	labelPeer   = 'p'
+	labelServer = 's'
+)
+
+var (
+	handshakeTimeout = 10 * time.Second
+
+	tunnelAuthErr      = errors.New("control link authentication failed")
+	versionMismatchErr = errors.New("control link protocol version mismatch")
+	badHelloErr        = errors.New("malformed control link hello")
+	emptySecretErr     = errors.New("control link secret is empty")
+)
+
+// WithControlAuth authenticates the peer of the control tunnel with
+// secret before any request is exchanged, id is the server id sent in
+// the hello.
+func WithControlAuth(id, secret string) ServerOption {
+	return func(s *srv) error {
+		if secret == "" {
+			return emptySecretErr
+		}
+		s.auth = &tunnelAuth{
+			id:     id,
+			secret: []byte(secret),
+		}
+		return nil
+	}
+}
+
+type tunnelAuth struct {
+	id     string
+	secret []byte
+}
+
+func helloMac(secret []byte, label byte, first, second []byte, id string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte{label})
+	h.Write(first)
+	h.Write(second)
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func writeHello(l Logger, w io.Writer, nonce, tail []byte) error {
+	v := make([]byte, lenVersion, lenVersion+nonceLen+len(tail))
+	binary.BigEndian.PutUint16(v, ProtocolVersion)
+	v = append(v, nonce...)
+	v = append(v, tail...)
+	return writeTLV(l, w, TLV{T: tHello, L: uint32(len(v)), V: v})
+}
+
+// readHello returns the nonce and the rest of a hello.
+func readHello(l Logger, r io.Reader) (nonce, tail []byte, err error) {
+	tlv, err := readTLV(l, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlv.T != tHello || len(tlv.V) < lenVersion+nonceLen {
+		l.Error("unexpected hello", "type", tlv.T, "len", len(tlv.V))
+		return nil, nil, badHelloErr
+	}
+	if v := binary.BigEndian.Uint16(tlv.V); v != ProtocolVersion {
+		l.Error("protocol version mismatch", "peer", v, "expect", ProtocolVersion)
+		return nil, nil, versionMismatchErr
+	}
+	return tlv.V[lenVersion : lenVersion+nonceLen], tlv.V[lenVersion+nonceLen:], nil
+}
+
+// handshake authenticates the peer on conn, it is the server side of
+// AcceptHandshake.
+func (a *tunnelAuth) handshake(l Logger, conn net.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if err = writeHello(l, conn, nonce, []byte(a.id)); err != nil {
+		return err
+	}
+
+	peerNonce, mac, err := readHello(l, conn)
+	if err != nil {
+		return err
+	}
+	expect := helloMac(a.secret, labelPeer, nonce, peerNonce, a.id)
+	if !hmac.Equal(mac, expect) {
+		l.Error("peer sent a wrong mac", "peer", conn.RemoteAddr())
+		return tunnelAuthErr
+	}
+
+	mac = helloMac(a.secret, labelServer, peerNonce, nonce, a.id)
+	return writeTLV(l, conn, TLV{T: tAuth, L: uint32(len(mac)), V: mac})
+}
+
+// AcceptHandshake is the peer side of the control tunnel handshake, it
+// returns the id of the server once both sides are authenticated with
+// secret.
+func AcceptHandshake(rw io.ReadWriter, secret []byte) (string, error) {
+	nonce, id, err := readHello(authLog, rw)
+	if err != nil {
+		return "", err
+	}
+	peerNonce, err := newNonce()
+	if err != nil {
+		return "", err
+	}
+	mac := helloMac(secret, labelPeer, nonce, peerNonce, string(id))
+	if err = writeHello(authLog, rw, peerNonce, mac); err != nil {
+		return "", err
+	}
+
+	tlv, err := ReadTLV(rw)
+	if err != nil {
+		return "", err
+	}
+	expect := helloMac(secret, labelServer, peerNonce, nonce, string(id))
+	if tlv.T != tAuth || !hmac.Equal(tlv.V, expect) {
+		authLog.Error("server failed to authenticate", "server", string(id))
+		return "", tunnelAuthErr
+	}
+	return string(id), nil
+}
@@ -0,0 +1,166 @@
+package proxy_server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	for name, c := range map[string]struct {
+		serverSecret, peerSecret string
+		peerErr, serverErr       error
+	}{
+		"ok": {
+			serverSecret: "secret",
+			peerSecret:   "secret",
+		},
+		"wrongSecret": {
+			serverSecret: "secret",
+			peerSecret:   "foo",
+			serverErr:    tunnelAuthErr,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			type result struct {
+				id  string
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				id, err := AcceptHandshake(c2, []byte(c.peerSecret))
+				if err != nil {
+					c2.Close()
+				}
+				done <- result{id, err}
+			}()
+
+			a := &tunnelAuth{id: "srv1", secret: []byte(c.serverSecret)}
+			err := a.handshake(authLog, c1)
+			if err != c.serverErr {
+				t.Errorf("expect server error %v, but got %v", c.serverErr, err)
+			}
+			if err != nil {
+				c1.Close()
+			}
+			r := <-done
+			if c.serverErr == nil {
+				if r.err != nil || r.id != "srv1" {
+					t.Errorf("expect peer to accept srv1, but got %q, %v", r.id, r.err)
+				}
+			} else if r.err == nil {
+				t.Error("peer should fail")
+			}
+		})
+	}
+}
+
+func TestHandshakeReflection(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// a peer without the secret echoes the server hello back
+	go func() {
+		tlv, err := ReadTLV(c2)
+		if err != nil {
+			return
+		}
+		WriteTLV(c2, tlv)
+	}()
+
+	a := &tunnelAuth{id: "", secret: []byte("secret")}
+	if err := a.handshake(authLog, c1); err != tunnelAuthErr {
+		t.Fatalf("expect %v, but got %v", tunnelAuthErr, err)
+	}
+}
+
+func TestReadHello(t *testing.T) {
+	hello := func(version uint16, n int) TLV {
+		v := make([]byte, n)
+		binary.BigEndian.PutUint16(v, version)
+		return TLV{T: tHello, L: uint32(n), V: v}
+	}
+	for name, c := range map[string]struct {
+		tlv TLV
+		err error
+	}{
+		"ok":         {tlv: hello(ProtocolVersion, lenVersion+nonceLen)},
+		"short":      {tlv: hello(ProtocolVersion, lenVersion+nonceLen-1), err: badHelloErr},
+		"wrongType":  {tlv: TLV{T: tPing, L: 0, V: []byte{}}, err: badHelloErr},
+		"badVersion": {tlv: hello(ProtocolVersion+1, lenVersion+nonceLen), err: versionMismatchErr},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			r, w := net.Pipe()
+			defer r.Close()
+			go WriteTLV(w, c.tlv)
+
+			_, _, err := readHello(authLog, r)
+			if err != c.err {
+				t.Errorf("expect error %v, but got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestSetupTunnelAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for name, c := range map[string]struct {
+		secret string
+		err    error
+	}{
+		"authenticated": {secret: "secret"},
+		"rejected":      {secret: "foo", err: tunnelAuthErr},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			s, err := NewServer("", "", "", WithControlAuth("srv1", "secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.cancel()
+			s.tunnelAddr = l.Addr().String()
+
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				if _, err = AcceptHandshake(conn, []byte(c.secret)); err != nil {
+					conn.Close()
+				}
+			}()
+
+			err = s.setupTunnel()
+			if err != c.err {
+				t.Fatalf("expect error %v, but got %v", c.err, err)
+			}
+			if err == nil {
+				s.tunnelCancel()
+				s.tunnelWaiter.Wait()
+				s.tunnelConn.Close()
+			}
+		})
+	}
+}
+
+func TestWithControlAuth(t *testing.T) {
+	if _, err := NewServer("", "", "", WithControlAuth("srv1", "")); err != emptySecretErr {
+		t.Fatalf("expect %v, but got %v", emptySecretErr, err)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/tw4452852/proxy_server"
 )
@@ -12,15 +16,40 @@ var (
 	clientControlAddr string
 	clientDataAddr    string
 	pluginAddr        string
+	configFile        string
+	metricsAddr       string
+	sessionsFile      string
+	maxMessageSize    int
+	ssMethod          string
+	ssPassword        string
+	agentMode         bool
+	debugLog          bool
+	jsonLog           bool
 	help              bool
 )
 
+const shutdownTimeout = 10 * time.Second
+
 func init() {
 	flag.BoolVar(&help, "h", false, "show help")
 	flag.StringVar(&clientControlAddr, "cc", "", "client control address")
 	flag.StringVar(&clientDataAddr, "cd", "", "client data address")
 	flag.StringVar(&pluginAddr, "p", "", "plugin address")
-	flag.BoolVar((*bool)(&proxy_server.Debug), "d", false, "debug log")
+	flag.StringVar(&configFile, "f", "", "toml config file")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve the metrics on /metrics of this address")
+	flag.StringVar(&sessionsFile, "sessions", "", "append a json record of each ended ss session to this file")
+	flag.StringVar(&ssMethod, "m", "", "shadowsocks cipher method, stream or aead, overrides config (default aes-128-cfb)")
+	flag.StringVar(&ssPassword, "k", "", "shadowsocks password, overrides config")
+	flag.BoolVar(&agentMode, "a", false, "agent mode, restart the server when it fails")
+	flag.BoolVar(&debugLog, "d", false, "debug log")
+	flag.BoolVar(&jsonLog, "j", false, "log in json")
+	flag.IntVar(&maxMessageSize, "maxmsg", proxy_server.DefaultMaxMessageSize, "max size in bytes of a control or plugin message")
+}
+
+func waitSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	<-c
 }
 
 func main() {
@@ -43,14 +72,96 @@ func main() {
 		fmt.Println("plugin address is nil")
 		os.Exit(1)
 	}
-	proxy_server.Debug.SetPrefix("[" + pluginAddr + "]")
+	level, format := proxy_server.LevelInfo, proxy_server.TextFormat
+	if debugLog {
+		level = proxy_server.LevelDebug
+	}
+	if jsonLog {
+		format = proxy_server.JSONFormat
+	}
+	proxy_server.SetLogger(proxy_server.NewLogger(os.Stderr, level, format).With("plugin", pluginAddr))
+	if metricsAddr != "" {
+		go proxy_server.ServeMetrics(metricsAddr)
+	}
+
+	var opts []proxy_server.ServerOption
+	if configFile != "" {
+		c, err := proxy_server.LoadConfig(configFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if ssMethod == "" {
+			ssMethod = c.SS.Method
+		}
+		if ssPassword == "" {
+			ssPassword = c.SS.Password
+		}
+		opts, err = c.TLSOptions()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts = append(opts, c.AuthOptions()...)
+		opts = append(opts, c.StandbyOptions()...)
+		opts = append(opts, c.SessionOptions()...)
+		opts = append(opts, c.RateOptions()...)
+		aclOpts, err := c.ACLOptions()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts = append(opts, aclOpts...)
+		resolverOpts, err := c.ResolverOptions()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts = append(opts, resolverOpts...)
+	}
+
+	opts = append(opts, proxy_server.WithMaxMessageSize(maxMessageSize))
+	if ssMethod != "" || ssPassword != "" {
+		opts = append(opts, proxy_server.WithCipher(ssMethod, ssPassword))
+	}
+	if sessionsFile != "" {
+		f, err := os.OpenFile(sessionsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts = append(opts, proxy_server.WithSessionSink(proxy_server.NewJSONSessionSink(f)))
+	}
 
-	s, err := proxy_server.NewServer(pluginAddr, clientControlAddr, clientDataAddr)
+	if agentMode {
+		a := proxy_server.NewAgent(func() (string, string, string, error) {
+			return pluginAddr, clientControlAddr, clientDataAddr, nil
+		}, opts...)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			waitSignal()
+			cancel()
+		}()
+		a.Run(ctx)
+		return
+	}
+
+	s, err := proxy_server.NewServer(pluginAddr, clientControlAddr, clientDataAddr, opts...)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	go func() {
+		waitSignal()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			fmt.Println(err)
+		}
+	}()
+
 	err = s.Loop()
 	if err != nil {
 		fmt.Println(err)
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/tw4452852/proxy_server"
 )
 
+const shutdownTimeout = 10 * time.Second
+
+func waitSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	<-c
+}
+
 func main() {
 	help := flag.Bool("h", false, "show help")
-	flag.BoolVar((*bool)(&proxy_server.Debug), "d", false, "debug log")
+	agentMode := flag.Bool("a", false, "agent mode, refetch vm addresses and restart the server when it fails")
+	debugLog := flag.Bool("d", false, "debug log")
+	jsonLog := flag.Bool("j", false, "log in json")
 
 	flag.Parse()
 
@@ -19,6 +33,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	level, format := proxy_server.LevelInfo, proxy_server.TextFormat
+	if *debugLog {
+		level = proxy_server.LevelDebug
+	}
+	if *jsonLog {
+		format = proxy_server.JSONFormat
+	}
+	proxy_server.SetLogger(proxy_server.NewLogger(os.Stderr, level, format))
+
 	w := proxy_server.NewWeb()
 	defer w.Exit()
 
@@ -27,6 +50,20 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	if *agentMode {
+		a := proxy_server.NewAgent(func() (string, string, string, error) {
+			c, d, err := w.GetVmAddress()
+			return p, c, d, err
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			waitSignal()
+			cancel()
+		}()
+		a.Run(ctx)
+		return
+	}
+
 	c, d, err := w.GetVmAddress()
 	if err != nil {
 		log.Fatalln(err)
@@ -37,6 +74,15 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	go func() {
+		waitSignal()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
 	err = s.Loop()
 	if err != nil {
 		log.Fatalln(err)
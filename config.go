@@ -1,24 +1,290 @@
 package proxy_server
 
 import (
+	"crypto/tls"
 	"io"
+	"net"
+	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type config struct {
-	Web webConfig
+	Web  webConfig
+	SS   ssConfig
+	TLS  tlsConfig
+	Auth authConfig
+	// standby vms of the control tunnel, in order
+	Standby []VM
+	Session sessionConfig
+	// bandwidth of the ss sessions in bytes per second
+	RateLimits RateLimits
+	ACL        aclConfig
+	DNS        dnsConfig
 }
 
 type webConfig struct {
 	Url string
 }
 
+type ssConfig struct {
+	Method   string
+	Password string
+}
+
+// sessionConfig bounds the ss sessions, the timeouts are durations
+// like "5m".
+type sessionConfig struct {
+	Idle     duration
+	Read     duration
+	Lifetime duration
+}
+
+func (c sessionConfig) timeouts() SessionTimeouts {
+	return SessionTimeouts{
+		Idle:     c.Idle.Duration,
+		Read:     c.Read.Duration,
+		Lifetime: c.Lifetime.Duration,
+	}
+}
+
+// aclConfig is the acl of the ss targets, see ACL for the rules. The
+// DenyPrivateRules come first if DenyPrivate is set.
+type aclConfig struct {
+	Default     string
+	DenyPrivate bool
+	Rules       []string
+}
+
+func (c aclConfig) enabled() bool {
+	return c.Default != "" || c.DenyPrivate || len(c.Rules) > 0
+}
+
+func (c aclConfig) acl() (*ACL, error) {
+	var rules []string
+	if c.DenyPrivate {
+		rules = append(rules, DenyPrivateRules...)
+	}
+	return NewACL(append(rules, c.Rules...), c.Default)
+}
+
+// dnsConfig is the resolver of the ss targets, see ResolverConfig, the
+// hosts map the domains to ips.
+type dnsConfig struct {
+	Servers     []string
+	Network     string
+	TTL         duration
+	NegativeTTL duration
+	Prefer      string
+	Hosts       map[string][]string
+}
+
+func (c dnsConfig) enabled() bool {
+	return len(c.Servers) > 0 || c.Network != "" || c.TTL.Duration != 0 ||
+		c.NegativeTTL.Duration != 0 || c.Prefer != "" || len(c.Hosts) > 0
+}
+
+func (c dnsConfig) resolver() (*Resolver, error) {
+	rc := ResolverConfig{
+		Servers:     c.Servers,
+		Network:     c.Network,
+		TTL:         c.TTL.Duration,
+		NegativeTTL: c.NegativeTTL.Duration,
+		Prefer:      c.Prefer,
+		Hosts:       make(map[string][]net.IP, len(c.Hosts)),
+	}
+	for h, addrs := range c.Hosts {
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, badResolverErr
+			}
+			rc.Hosts[h] = append(rc.Hosts[h], ip)
+		}
+	}
+	return NewResolver(rc)
+}
+
+// duration is a time.Duration written as a string.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(b []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(b))
+	return err
+}
+
+// authConfig enables the control tunnel handshake once Secret is set.
+type authConfig struct {
+	ID     string
+	Secret string
+}
+
+// tlsConfig enables tls on a link once one of its fields is set.
+type tlsConfig struct {
+	Control tlsLinkConfig
+	Data    tlsLinkConfig
+	Plugin  tlsLinkConfig
+}
+
+type tlsLinkConfig struct {
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+}
+
+func (c tlsLinkConfig) enabled() bool {
+	return c != tlsLinkConfig{}
+}
+
+func (c tlsLinkConfig) tlsConfig() (*tls.Config, error) {
+	return NewTLSConfig(c.CA, c.Cert, c.Key, c.ServerName)
+}
+
+func (c *config) validate() error {
+	if c.SS.Method != "" || c.SS.Password != "" {
+		if _, err := newSSCipher(c.SS.Method, c.SS.Password); err != nil {
+			return err
+		}
+	}
+	for _, l := range []tlsLinkConfig{c.TLS.Control, c.TLS.Data, c.TLS.Plugin} {
+		if (l.Cert == "") != (l.Key == "") {
+			return certNoKeyErr
+		}
+	}
+	if c.Auth.ID != "" && c.Auth.Secret == "" {
+		return emptySecretErr
+	}
+	for _, vm := range c.Standby {
+		if vm.ControlAddr == "" || vm.DataAddr == "" {
+			return badVMErr
+		}
+	}
+	if err := c.Session.timeouts().validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimits.validate(); err != nil {
+		return err
+	}
+	if c.ACL.enabled() {
+		if _, err := c.ACL.acl(); err != nil {
+			return err
+		}
+	}
+	if c.DNS.enabled() {
+		if _, err := c.DNS.resolver(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuthOptions returns the server options of the control tunnel
+// handshake, if it is enabled.
+func (c *config) AuthOptions() []ServerOption {
+	if c.Auth.Secret == "" {
+		return nil
+	}
+	return []ServerOption{WithControlAuth(c.Auth.ID, c.Auth.Secret)}
+}
+
+// StandbyOptions returns the server options of the standby vms, if
+// there are any.
+func (c *config) StandbyOptions() []ServerOption {
+	if len(c.Standby) == 0 {
+		return nil
+	}
+	return []ServerOption{WithStandbyVMs(c.Standby...)}
+}
+
+// SessionOptions returns the server options of the session timeouts,
+// if there are any.
+func (c *config) SessionOptions() []ServerOption {
+	if c.Session == (sessionConfig{}) {
+		return nil
+	}
+	return []ServerOption{WithSessionTimeouts(c.Session.timeouts())}
+}
+
+// RateOptions returns the server options of the rate limits, if there
+// are any.
+func (c *config) RateOptions() []ServerOption {
+	if c.RateLimits == (RateLimits{}) {
+		return nil
+	}
+	return []ServerOption{WithRateLimits(c.RateLimits)}
+}
+
+// ACLOptions returns the server options of the acl, if it is enabled.
+func (c *config) ACLOptions() ([]ServerOption, error) {
+	if !c.ACL.enabled() {
+		return nil, nil
+	}
+	acl, err := c.ACL.acl()
+	if err != nil {
+		return nil, err
+	}
+	return []ServerOption{WithACL(acl)}, nil
+}
+
+// ResolverOptions returns the server options of the resolver, if it is
+// configured.
+func (c *config) ResolverOptions() ([]ServerOption, error) {
+	if !c.DNS.enabled() {
+		return nil, nil
+	}
+	r, err := c.DNS.resolver()
+	if err != nil {
+		return nil, err
+	}
+	return []ServerOption{WithResolver(r)}, nil
+}
+
+// TLSOptions returns the server options of the links with tls enabled.
+func (c *config) TLSOptions() ([]ServerOption, error) {
+	var opts []ServerOption
+	for _, l := range []struct {
+		c   tlsLinkConfig
+		opt func(*tls.Config) ServerOption
+	}{
+		{c.TLS.Control, WithControlTLS},
+		{c.TLS.Data, WithDataTLS},
+		{c.TLS.Plugin, WithPluginTLS},
+	} {
+		if !l.c.enabled() {
+			continue
+		}
+		tc, err := l.c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, l.opt(tc))
+	}
+	return opts, nil
+}
+
 func getConfig(r io.Reader) (*config, error) {
 	c := &config{}
 	_, err := toml.DecodeReader(r, c)
 	if err != nil {
 		return nil, err
 	}
+	if err = c.validate(); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
+
+// LoadConfig reads and validates the toml configuration file at path.
+func LoadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return getConfig(f)
+}
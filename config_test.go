@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetConfig(t *testing.T) {
@@ -27,6 +28,213 @@ func TestGetConfig(t *testing.T) {
 			shouldErr: false,
 			expect:    &config{Web: webConfig{Url: "https://123"}},
 		},
+		"ss": {
+			input: `
+			[ss]
+			method = "aes-256-cfb"
+			password = "secret"
+			`,
+			shouldErr: false,
+			expect: &config{SS: ssConfig{
+				Method:   "aes-256-cfb",
+				Password: "secret",
+			}},
+		},
+		"ssBadMethod": {
+			input: `
+			[ss]
+			method = "foo"
+			password = "secret"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"ssNoPassword": {
+			input: `
+			[ss]
+			method = "aes-256-cfb"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"tls": {
+			input: `
+			[tls.control]
+			ca = "ca.pem"
+			cert = "client.pem"
+			key = "client.key"
+			[tls.data]
+			servername = "vm"
+			`,
+			shouldErr: false,
+			expect: &config{TLS: tlsConfig{
+				Control: tlsLinkConfig{
+					CA:   "ca.pem",
+					Cert: "client.pem",
+					Key:  "client.key",
+				},
+				Data: tlsLinkConfig{ServerName: "vm"},
+			}},
+		},
+		"tlsCertNoKey": {
+			input: `
+			[tls.plugin]
+			cert = "client.pem"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"auth": {
+			input: `
+			[auth]
+			id = "srv1"
+			secret = "secret"
+			`,
+			shouldErr: false,
+			expect: &config{Auth: authConfig{
+				ID:     "srv1",
+				Secret: "secret",
+			}},
+		},
+		"authNoSecret": {
+			input: `
+			[auth]
+			id = "srv1"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"standby": {
+			input: `
+			[[standby]]
+			controladdr = "vm2:1"
+			dataaddr = "vm2:2"
+			[[standby]]
+			controladdr = "vm3:1"
+			dataaddr = "vm3:2"
+			`,
+			shouldErr: false,
+			expect: &config{Standby: []VM{
+				{ControlAddr: "vm2:1", DataAddr: "vm2:2"},
+				{ControlAddr: "vm3:1", DataAddr: "vm3:2"},
+			}},
+		},
+		"standbyNoData": {
+			input: `
+			[[standby]]
+			controladdr = "vm2:1"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"session": {
+			input: `
+			[session]
+			idle = "5m"
+			lifetime = "2h"
+			`,
+			shouldErr: false,
+			expect: &config{Session: sessionConfig{
+				Idle:     duration{5 * time.Minute},
+				Lifetime: duration{2 * time.Hour},
+			}},
+		},
+		"sessionNegative": {
+			input: `
+			[session]
+			read = "-1s"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"sessionBadDuration": {
+			input: `
+			[session]
+			idle = "5"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"rateLimits": {
+			input: `
+			[ratelimits.global]
+			up = 1000000
+			[ratelimits.perkey]
+			down = 2000
+			`,
+			shouldErr: false,
+			expect: &config{RateLimits: RateLimits{
+				Global: Rate{Up: 1000000},
+				PerKey: Rate{Down: 2000},
+			}},
+		},
+		"rateLimitsNegative": {
+			input: `
+			[ratelimits.perkey]
+			up = -1
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"acl": {
+			input: `
+			[acl]
+			default = "deny"
+			denyprivate = true
+			rules = ["allow * 80,443"]
+			`,
+			shouldErr: false,
+			expect: &config{ACL: aclConfig{
+				Default:     "deny",
+				DenyPrivate: true,
+				Rules:       []string{"allow * 80,443"},
+			}},
+		},
+		"aclBadRule": {
+			input: `
+			[acl]
+			rules = ["allow *.example.com 0"]
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"dns": {
+			input: `
+			[dns]
+			servers = ["8.8.8.8:53"]
+			network = "tcp"
+			ttl = "1m"
+			negativettl = "10s"
+			prefer = "ipv4"
+			[dns.hosts]
+			"a.example" = ["10.0.0.1"]
+			`,
+			shouldErr: false,
+			expect: &config{DNS: dnsConfig{
+				Servers:     []string{"8.8.8.8:53"},
+				Network:     "tcp",
+				TTL:         duration{time.Minute},
+				NegativeTTL: duration{10 * time.Second},
+				Prefer:      "ipv4",
+				Hosts:       map[string][]string{"a.example": {"10.0.0.1"}},
+			}},
+		},
+		"dnsBadNetwork": {
+			input: `
+			[dns]
+			network = "quic"
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
+		"dnsBadHost": {
+			input: `
+			[dns.hosts]
+			"a.example" = ["a.b.c.d"]
+			`,
+			shouldErr: true,
+			expect:    nil,
+		},
 		"inValid": {
 			input: `
 			[web]
@@ -0,0 +1,123 @@
+package proxy_server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// VM is the control and data addresses of a vm.
+type VM struct {
+	ControlAddr string
+	DataAddr    string
+}
+
+var (
+	failbackInterval = 30 * time.Second
+
+	badVMErr = errors.New("vm address is empty")
+)
+
+// WithStandbyVMs adds the vms the control tunnel fails over to, in
+// order, after the primary one given to NewServer. The primary one is
+// tried again every failbackInterval while a standby one is used.
+func WithStandbyVMs(vms ...VM) ServerOption {
+	return func(s *srv) error {
+		for _, vm := range vms {
+			if vm.ControlAddr == "" || vm.DataAddr == "" {
+				return badVMErr
+			}
+		}
+		s.vms = append(s.vms, vms...)
+		return nil
+	}
+}
+
+// useVM makes vm i the active one, it is only called by Loop.
+func (s *srv) useVM(i int) {
+	s.active = i
+	s.tunnelAddr = s.vms[i].ControlAddr
+	s.dataAddr = s.vms[i].DataAddr
+}
+
+// failover switches to the vm after the active one.
+func (s *srv) failover() {
+	s.useVM((s.active + 1) % len(s.vms))
+	s.log.Info("fail over", "vm", s.tunnelAddr)
+}
+
+// scheduleFailback tries the primary vm again later if a standby one
+// is used, Loop picks it up from s.failback.
+func (s *srv) scheduleFailback() {
+	if s.active == 0 || s.failbackPending {
+		return
+	}
+	s.failbackPending = true
+	go func(c <-chan time.Time) {
+		select {
+		case <-c:
+		case <-s.ctx.Done():
+			return
+		}
+		select {
+		case s.failback <- struct{}{}:
+		case <-s.ctx.Done():
+		}
+	}(s.clock.After(failbackInterval))
+}
+
+// tunnelProbe is the control tunnel dialed to vm i.
+type tunnelProbe struct {
+	vm   int
+	conn net.Conn
+	err  error
+}
+
+// failbackTunnel probes the primary vm in the background, so that a
+// blackholed one doesn't stall Loop, which picks the result up from
+// s.probed.
+func (s *srv) failbackTunnel() {
+	if s.active == 0 || s.reconnecting || s.probing {
+		return
+	}
+	s.probing = true
+	go func(addr string) {
+		conn, err := s.dialTunnel(addr)
+		select {
+		case s.probed <- tunnelProbe{0, conn, err}:
+		case <-s.ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}(s.vms[0].ControlAddr)
+}
+
+// handleProbe switches the tunnel back to the primary vm once it is
+// healthy, the standby one is kept otherwise.
+func (s *srv) handleProbe(p tunnelProbe) error {
+	s.probing = false
+	if p.err != nil {
+		s.log.Debug("primary vm is still down", "err", p.err)
+		s.scheduleFailback()
+		return p.err
+	}
+	conn := p.conn
+	// the tunnel moved on while probing
+	if s.active == 0 || s.reconnecting {
+		conn.Close()
+		return nil
+	}
+
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+	if s.isClosing() {
+		conn.Close()
+		return shutdownErr
+	}
+	s.stopTunnel()
+	s.useVM(0)
+	s.log.Info("fail back", "vm", s.tunnelAddr)
+	s.startTunnel(conn)
+	return nil
+}
@@ -0,0 +1,208 @@
+package proxy_server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWithStandbyVMs(t *testing.T) {
+	for name, c := range map[string]struct {
+		vms       []VM
+		shouldErr bool
+	}{
+		"none":   {},
+		"two":    {vms: []VM{{"vm2:1", "vm2:2"}, {"vm3:1", "vm3:2"}}},
+		"noData": {vms: []VM{{ControlAddr: "vm2:1"}}, shouldErr: true},
+	} {
+		s, err := NewServer("", "", "", WithStandbyVMs(c.vms...))
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%s: expect error %v, but got %v", name, c.shouldErr, err)
+		}
+		if s != nil {
+			if expect := len(c.vms) + 1; len(s.vms) != expect {
+				t.Errorf("%s: expect %d vms, but got %d", name, expect, len(s.vms))
+			}
+			s.cancel()
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// the primary vm is down at first
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryAddr := primary.Addr().String()
+	primary.Close()
+	standby, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+
+	s, err := NewServer("", primaryAddr, "primary",
+		WithStandbyVMs(VM{ControlAddr: standby.Addr().String(), DataAddr: "standby"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tunnel goroutines read the globals other tests change
+	defer s.Shutdown(context.Background())
+	clk := newFakeClock()
+	s.clock = clk
+	r, w := net.Pipe()
+	setPluginConn(s, w)
+	go s.Loop()
+
+	expectConnectOk := func() {
+		expect := TLV{T: pTunnelConnectOk, L: 0, V: []byte{}}
+		got, err := ReadTLV(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+	}
+
+	// fail over to the standby one without reporting a failure
+	conn, err := standby.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectAnnounce(t, conn, tFeatures)
+	expectConnectOk()
+	ft := clk.next(t)
+	if ft.d != failbackInterval {
+		t.Errorf("expect failback in %s, but got %s", failbackInterval, ft.d)
+	}
+
+	// fail back once the primary one is healthy
+	primary, err = net.Listen("tcp", primaryAddr)
+	if err != nil {
+		t.Skipf("can't listen on %s again: %s", primaryAddr, err)
+	}
+	defer primary.Close()
+	ft.c <- time.Now()
+	pconn, err := primary.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	expectAnnounce(t, pconn, tFeatures)
+	expectConnectOk()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("standby tunnel should be closed")
+	}
+
+	// fail over again once the primary one times out
+	s.tunnelErr <- tunnelTimeoutErr
+	conn, err = standby.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectConnectOk()
+}
+
+func TestFailbackProbe(t *testing.T) {
+	// the primary vm is down at first
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryAddr := primary.Addr().String()
+	primary.Close()
+	standby, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	go func() {
+		for {
+			conn, err := standby.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go AcceptHandshake(conn, []byte("secret"))
+		}
+	}()
+
+	s, err := NewServer("", primaryAddr, "primary", WithControlAuth("srv1", "secret"),
+		WithStandbyVMs(VM{ControlAddr: standby.Addr().String(), DataAddr: "standby"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tunnel goroutines read the globals other tests change
+	defer s.Shutdown(context.Background())
+	clk := newFakeClock()
+	s.clock = clk
+	r, w := net.Pipe()
+	setPluginConn(s, w)
+	go s.Loop()
+
+	expectTLV := func(expect TLV) {
+		t.Helper()
+		r.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := ReadTLV(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+	}
+	expectTLV(TLV{T: pTunnelConnectOk, L: 0, V: []byte{}})
+	ft := clk.next(t)
+
+	// the primary one is back but never answers the handshake
+	primary, err = net.Listen("tcp", primaryAddr)
+	if err != nil {
+		t.Skipf("can't listen on %s again: %s", primaryAddr, err)
+	}
+	defer primary.Close()
+	ft.c <- time.Now()
+	pconn, err := primary.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+
+	// Loop still handles the requests while probing
+	s.reqs <- &Request{Typ: TunnelReconnectFailed}
+	expectTLV(TLV{T: pTunnelReconnectFailed, L: 0, V: []byte{}})
+}
+
+func TestFailoverAllDown(t *testing.T) {
+	s, err := NewServer("", "127.0.0.1:1", "primary",
+		WithStandbyVMs(VM{ControlAddr: "127.0.0.1:2", DataAddr: "standby"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+	clk := newFakeClock()
+	s.clock = clk
+	r, w := net.Pipe()
+	setPluginConn(s, w)
+	go s.Loop()
+
+	// reported once all the vms fail
+	expect := TLV{T: pTunnelReconnectFailed, L: 0, V: []byte{}}
+	got, err := ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+	ft := clk.next(t)
+	if ft.d <= 0 {
+		t.Errorf("expect a retry, but got delay %s", ft.d)
+	}
+}
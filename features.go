@@ -0,0 +1,101 @@
+package proxy_server
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Capabilities is a set of optional protocol features, a request type
+// added after the first version is only sent to a peer which announced
+// the capability of it.
+type Capabilities uint32
+
+const (
+	// CapServerShutdown: the plugin understands pServerShutdown.
+	CapServerShutdown Capabilities = 1 << iota
+	// CapLargePayload: the peer reads extended TLVs.
+	CapLargePayload
+	// CapTaskID: the peer keeps the task ids, the plugin is told the
+	// timeouts.
+	CapTaskID
+	// CapTaskAck: the vm acks the tasks with an id once it takes them,
+	// they are kept by the server until then.
+	CapTaskAck
+	// CapPingStats: the vm echoes the ping payload, the plugin is told
+	// the ping stats.
+	CapPingStats
+	// CapSessionRecord: the plugin is told the records of the ended ss
+	// sessions.
+	CapSessionRecord
+)
+
+// Features is what a link speaks: the protocol version and the
+// capabilities. Both sides announce theirs once the link is set up, the
+// server by pFeaturesAck on the plugin link and tFeatures on the
+// control link, each side speaks the negotiated ones once it knows the
+// other's. A peer which never announces them is a legacy one, it has to
+// skip the announcement of the server.
+type Features struct {
+	Version uint16
+	Caps    Capabilities
+}
+
+const lenFeatures = 2 + 4 // version + capabilities
+
+var (
+	// LocalFeatures is what this server speaks.
+	LocalFeatures = Features{
+		Version: ProtocolVersion,
+		Caps: CapServerShutdown | CapLargePayload | CapTaskID | CapTaskAck | CapPingStats |
+			CapSessionRecord,
+	}
+	// LegacyFeatures is assumed until the peer announces its own.
+	LegacyFeatures = Features{}
+
+	unsupportedErr = errors.New("request is not supported by peer")
+	badFeaturesErr = errors.New("malformed features")
+)
+
+// Negotiate returns the features both f and peer speak.
+func (f Features) Negotiate(peer Features) Features {
+	n := Features{
+		Version: f.Version,
+		Caps:    f.Caps & peer.Caps,
+	}
+	if peer.Version < n.Version {
+		n.Version = peer.Version
+	}
+	return n
+}
+
+// Has reports whether all the capabilities in c are spoken.
+func (f Features) Has(c Capabilities) bool {
+	return f.Caps&c == c
+}
+
+func (f Features) require(c Capabilities) error {
+	if !f.Has(c) {
+		return unsupportedErr
+	}
+	return nil
+}
+
+func (f Features) marshal() []byte {
+	b := make([]byte, lenFeatures)
+	binary.BigEndian.PutUint16(b, f.Version)
+	binary.BigEndian.PutUint32(b[2:], uint32(f.Caps))
+	return b
+}
+
+// unmarshalFeatures ignores the trailing bytes, they are left for the
+// future versions.
+func unmarshalFeatures(l Logger, b []byte) (Features, error) {
+	if len(b) < lenFeatures {
+		l.Error("features are too short", "expect", lenFeatures, "len", len(b))
+		return Features{}, badFeaturesErr
+	}
+	return Features{
+		Version: binary.BigEndian.Uint16(b),
+		Caps:    Capabilities(binary.BigEndian.Uint32(b[2:])),
+	}, nil
+}
@@ -0,0 +1,89 @@
+package proxy_server
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	for name, c := range map[string]struct {
+		local, peer, expect Features
+	}{
+		"legacy": {
+			local:  LocalFeatures,
+			peer:   LegacyFeatures,
+			expect: Features{Version: 0, Caps: 0},
+		},
+		"same": {
+			local:  LocalFeatures,
+			peer:   LocalFeatures,
+			expect: LocalFeatures,
+		},
+		"newerPeer": {
+			local:  Features{Version: 1, Caps: CapServerShutdown},
+			peer:   Features{Version: 3, Caps: CapServerShutdown | 1<<10},
+			expect: Features{Version: 1, Caps: CapServerShutdown},
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := c.local.Negotiate(c.peer); !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("expect %#v, but got %#v", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestFeaturesMarshal(t *testing.T) {
+	f := Features{Version: 2, Caps: 0x01020304}
+	got, err := unmarshalFeatures(tunnelLog, append(f.marshal(), 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != f {
+		t.Errorf("expect %#v, but got %#v", f, got)
+	}
+	if _, err = unmarshalFeatures(tunnelLog, []byte{0, 1}); err != badFeaturesErr {
+		t.Errorf("expect error %v, but got %v", badFeaturesErr, err)
+	}
+}
+
+// expectAnnounce reads the features the server announces on a link, by
+// a message of type typ.
+func expectAnnounce(t *testing.T, r io.Reader, typ uint16) {
+	t.Helper()
+	v := LocalFeatures.marshal()
+	expect := TLV{T: typ, L: uint32(len(v)), V: v}
+	got, err := ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+}
+
+func TestHandleFeatures(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	if f := loadFeatures(&s.pluginFeat); f != LegacyFeatures {
+		t.Fatalf("expect legacy features, but got %#v", f)
+	}
+	err = s.handleRequest(&Request{
+		Typ:      PluginFeatures,
+		Features: Features{Version: 2, Caps: LocalFeatures.Caps},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := loadFeatures(&s.pluginFeat); f != LocalFeatures {
+		t.Errorf("expect %#v, but got %#v", LocalFeatures, f)
+	}
+}
@@ -0,0 +1,166 @@
+package proxy_server
+
+import (
+	"errors"
+)
+
+var (
+	defaultJournalSize = 256
+
+	invalidJournalErr = errors.New("invalid task journal size")
+)
+
+// WithTaskJournal sets how many unconfirmed tasks are kept for the
+// control tunnel, the oldest one is dropped once it is full.
+func WithTaskJournal(size int) ServerOption {
+	return func(s *srv) error {
+		if size <= 0 {
+			return invalidJournalErr
+		}
+		s.journal = newTaskJournal(size)
+		return nil
+	}
+}
+
+// taskJournal keeps the tasks pushed by the plugin, in order, until the
+// vm confirms them: by a tTaskAck if it speaks CapTaskAck, once they
+// are queued on the tunnel otherwise. They are replayed once a new
+// tunnel is ready. It also remembers the ids of
+// the last results and timeouts to suppress the duplicated or late
+// results. It is only touched by Loop.
+type taskJournal struct {
+	size  int
+	tasks []*Request
+
+	// ring of the ids with a result
+	done    map[uint32]struct{}
+	doneIDs []uint32
+	doneOff int
+
+	log Logger
+}
+
+func newTaskJournal(size int) *taskJournal {
+	return &taskJournal{
+		size: size,
+		done: make(map[uint32]struct{}),
+		log:  journalLog,
+	}
+}
+
+func (j *taskJournal) index(id uint32) int {
+	for i, t := range j.tasks {
+		if t.TaskID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// add keeps req, it returns false if a task with the same id is kept
+// already. The result of a former task with the id is forgotten.
+func (j *taskJournal) add(req *Request) bool {
+	if j.index(req.TaskID) >= 0 {
+		return false
+	}
+	j.forget(req.TaskID)
+	if len(j.tasks) == j.size {
+		j.log.Error("journal is full, drop task", "task", j.tasks[0].TaskID)
+		j.tasks = j.tasks[1:]
+	}
+	j.tasks = append(j.tasks, req)
+	return true
+}
+
+// confirm forgets task id, it returns false if it is not kept.
+func (j *taskJournal) confirm(id uint32) bool {
+	i := j.index(id)
+	if i < 0 {
+		return false
+	}
+	j.tasks = append(j.tasks[:i], j.tasks[i+1:]...)
+	return true
+}
+
+// pending returns the unconfirmed tasks in the order they are pushed.
+func (j *taskJournal) pending() []*Request {
+	return append([]*Request(nil), j.tasks...)
+}
+
+// finish records the result of task id, it returns false if the
+// result is a duplicated one.
+func (j *taskJournal) finish(id uint32) bool {
+	j.confirm(id)
+	if _, ok := j.done[id]; ok {
+		return false
+	}
+	if len(j.doneIDs) < j.size {
+		j.doneIDs = append(j.doneIDs, id)
+	} else {
+		delete(j.done, j.doneIDs[j.doneOff])
+		j.doneIDs[j.doneOff] = id
+		j.doneOff = (j.doneOff + 1) % j.size
+	}
+	j.done[id] = struct{}{}
+	return true
+}
+
+// forget drops id from the last results, its slot of the ring is
+// cleared, 0 is never an id.
+func (j *taskJournal) forget(id uint32) {
+	if _, ok := j.done[id]; !ok {
+		return
+	}
+	delete(j.done, id)
+	for i, d := range j.doneIDs {
+		if d == id {
+			j.doneIDs[i] = 0
+		}
+	}
+}
+
+// sendTask writes task req to the tunnel, the journal keeps it until
+// it is confirmed.
+func (s *srv) sendTask(req *Request) {
+	if s.tunnelConn == nil || s.replayPending {
+		s.log.Debug("tunnel is not ready, keep task", "task", req.TaskID)
+		return
+	}
+	err := s.putCtrRequest(req)
+	if err == nil && !loadFeatures(&s.tunnelFeat).Has(CapTaskAck) {
+		s.journal.confirm(req.TaskID)
+	}
+}
+
+// tunnelRequest reports whether requests of type t are read from the
+// control tunnel.
+func tunnelRequest(t RequestType) bool {
+	switch t {
+	case CreateSSConnect, CreateSSUDPConnect, TaskResult, TaskAck, Ping, TunnelFeatures:
+		return true
+	}
+	return false
+}
+
+// tunnelReady replays the unconfirmed tasks once req, the first
+// request of the vm on a new tunnel, is handled: the features are
+// negotiated by then, a legacy vm never announces them and speaks
+// anything else first.
+func (s *srv) tunnelReady(req *Request) {
+	if !s.replayPending || !tunnelRequest(req.Typ) {
+		return
+	}
+	s.replayPending = false
+	s.replayTasks()
+}
+
+// replayTasks resends the unconfirmed tasks.
+func (s *srv) replayTasks() {
+	tasks := s.journal.pending()
+	if len(tasks) > 0 {
+		s.log.Info("replay tasks", "count", len(tasks))
+	}
+	for _, req := range tasks {
+		s.sendTask(req)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy_server
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTaskJournal(t *testing.T) {
+	j := newTaskJournal(2)
+	for _, id := range []uint32{1, 2, 3} {
+		if !j.add(&Request{Typ: PushTask, TaskID: id}) {
+			t.Errorf("task %d should be kept", id)
+		}
+	}
+	if j.add(&Request{Typ: PushTask, TaskID: 3}) {
+		t.Error("duplicated task should be suppressed")
+	}
+
+	// the oldest one is dropped
+	var ids []uint32
+	for _, req := range j.pending() {
+		ids = append(ids, req.TaskID)
+	}
+	if expect := []uint32{2, 3}; !reflect.DeepEqual(ids, expect) {
+		t.Errorf("expect pending tasks %v, but got %v", expect, ids)
+	}
+
+	if !j.confirm(2) || j.confirm(2) {
+		t.Error("task 2 should be confirmed once")
+	}
+	if !j.finish(3) || j.finish(3) {
+		t.Error("duplicated result should be suppressed")
+	}
+	if len(j.pending()) != 0 {
+		t.Errorf("expect no pending task, but got %d", len(j.pending()))
+	}
+
+	// only the last results are remembered
+	j.finish(4)
+	j.finish(5)
+	if !j.finish(3) {
+		t.Error("old result should be forgotten")
+	}
+
+	// the result of a task reusing an id is not a duplicated one
+	j.add(&Request{Typ: PushTask, TaskID: 5})
+	if !j.finish(5) {
+		t.Error("result of reused id should not be suppressed")
+	}
+	if j.finish(3) {
+		t.Error("other results should be remembered")
+	}
+}
+
+func TestTaskReplay(t *testing.T) {
+	for name, c := range map[string]struct {
+		// the first request of the vm on a new tunnel
+		first *Request
+		// replayed again on the next tunnel
+		kept bool
+	}{
+		"ack":    {first: &Request{Typ: TunnelFeatures, Features: LocalFeatures}, kept: true},
+		"legacy": {first: &Request{Typ: Ping}},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewServer("", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.cancel()
+			pr, pw := net.Pipe()
+			defer pr.Close()
+			go io.Copy(io.Discard, pr)
+			setPluginConn(s, pw)
+
+			// pushed while the tunnel is down
+			task := &Request{Typ: PushTask, TaskID: 3, TaskData: []byte{1}}
+			s.handleRequest(task)
+			s.handleRequest(task)
+
+			tr, tw := net.Pipe()
+			defer tr.Close()
+			setTunnelConn(s, tw)
+
+			expectTLV := func(expect TLV) {
+				t.Helper()
+				got, err := ReadTLV(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, expect) {
+					t.Fatalf("expect %#v, but got %#v", expect, got)
+				}
+			}
+			expectTask := func(id uint32) {
+				t.Helper()
+				if c.kept {
+					expectTLV(TLV{T: tTaskID, L: 5, V: []byte{0, 0, 0, byte(id), 1}})
+				} else {
+					expectTLV(TLV{T: tTask, L: 1, V: []byte{1}})
+				}
+			}
+			// the order of a new tunnel: connected, then the vm speaks
+			replay := func(push bool) {
+				t.Helper()
+				s.tunnelFeat.Store(LegacyFeatures)
+				s.handleRequest(&Request{Typ: TunnelConnectOk})
+				if push {
+					// held until the features are known
+					s.handleRequest(&Request{Typ: PushTask, TaskID: 4, TaskData: []byte{1}})
+				}
+				s.handleRequest(c.first)
+				expectTask(3)
+				expectTask(4)
+			}
+			replay(true)
+			if kept := len(s.journal.pending()) == 2; kept != c.kept {
+				t.Fatalf("expect tasks kept %v, but got %v", c.kept, kept)
+			}
+			if c.kept {
+				replay(false)
+				s.handleRequest(&Request{Typ: TaskAck, TaskID: 3})
+				s.handleRequest(&Request{Typ: TaskAck, TaskID: 4})
+				if len(s.journal.pending()) != 0 {
+					t.Error("acked tasks should be forgotten")
+				}
+			}
+		})
+	}
+}
+
+func TestTaskReplayWithoutID(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+	pr, pw := net.Pipe()
+	defer pr.Close()
+	setPluginConn(s, pw)
+	s.pluginFeat.Store(LocalFeatures)
+
+	// pushed without an id while the tunnel is down
+	s.handleRequest(&Request{Typ: PushTask, TaskData: []byte{1}})
+	if len(s.journal.pending()) != 1 {
+		t.Fatal("task without an id should be kept")
+	}
+
+	tr, tw := net.Pipe()
+	defer tr.Close()
+	setTunnelConn(s, tw)
+	expectTLV := func(r net.Conn, expect TLV) {
+		t.Helper()
+		got, err := ReadTLV(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+	}
+	s.handleRequest(&Request{Typ: TunnelConnectOk})
+	expectTLV(pr, TLV{T: pTunnelConnectOk, L: 0, V: []byte{}})
+	s.handleRequest(&Request{Typ: TunnelFeatures, Features: LocalFeatures})
+	// replayed with the id given by the server
+	expectTLV(tr, TLV{T: tTaskID, L: 5, V: []byte{0x80, 0, 0, 1, 1}})
+
+	s.handleRequest(&Request{Typ: TaskAck, TaskID: localTaskBit | 1})
+	if len(s.journal.pending()) != 0 {
+		t.Error("acked task should be forgotten")
+	}
+	// the plugin gets the result without it
+	s.handleRequest(&Request{Typ: TaskResult, TaskID: localTaskBit | 1, TaskData: []byte{2}})
+	expectTLV(pr, TLV{T: pTaskResult, L: 1, V: []byte{2}})
+}
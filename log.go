@@ -1,33 +1,242 @@
 package proxy_server
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type DebugLog bool
+// Level is the severity of a log record.
+type Level int
 
-var (
-	Debug DebugLog
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Format is how the records are written.
+type Format int
+
+const (
+	// TextFormat: time level msg key=value ...
+	TextFormat Format = iota
+	// JSONFormat: one json object per line.
+	JSONFormat
 )
 
+// Logger writes leveled records, kv are the key/value pairs of their
+// fields, e.g. "conn", id, "key", socketKey.
+type Logger interface {
+	Enabled(level Level) bool
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	// With returns a logger adding kv to all its records.
+	With(kv ...interface{}) Logger
+}
+
+type logOutput struct {
+	lock   sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}
+
+type logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// NewLogger returns a logger writing the records at level or above to
+// w in format.
+func NewLogger(w io.Writer, level Level, format Format) Logger {
+	return &logger{out: &logOutput{w: w, level: level, format: format}}
+}
+
+func (l *logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *logger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &logger{out: l.out, fields: fields}
+}
+
+func (l *logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+
+	var b bytes.Buffer
+	if l.out.format == JSONFormat {
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		eachField(l.fields, kv, func(k string, v interface{}) {
+			b.WriteByte(',')
+			writeJSON(&b, k)
+			b.WriteByte(':')
+			writeJSON(&b, fieldValue(v))
+		})
+		b.WriteString("}\n")
+	} else {
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteByte(' ')
+		b.WriteString(msg)
+		eachField(l.fields, kv, func(k string, v interface{}) {
+			b.WriteString(" " + k + "=")
+			s := fmt.Sprint(fieldValue(v))
+			if s == "" || strings.ContainsAny(s, " =\"\n") {
+				s = strconv.Quote(s)
+			}
+			b.WriteString(s)
+		})
+		b.WriteByte('\n')
+	}
+
+	l.out.lock.Lock()
+	l.out.w.Write(b.Bytes())
+	l.out.lock.Unlock()
+}
+
+// eachField calls f on the key/value pairs of fields then kv, a key
+// without value is given "(MISSING)".
+func eachField(fields, kv []interface{}, f func(string, interface{})) {
+	for _, pairs := range [][]interface{}{fields, kv} {
+		for i := 0; i < len(pairs); i += 2 {
+			k := fmt.Sprint(pairs[i])
+			if i+1 < len(pairs) {
+				f(k, pairs[i+1])
+			} else {
+				f(k, "(MISSING)")
+			}
+		}
+	}
+}
+
+// fieldValue turns the errors and the stringers into strings.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		d, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(d)
+}
+
+var std atomic.Value // Logger
+
 func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	SetLogger(NewLogger(os.Stderr, LevelInfo, TextFormat))
+}
+
+// SetLogger replaces the default logger, it is used by the code not
+// bound to a server and by the servers created without WithLogger.
+func SetLogger(l Logger) {
+	std.Store(&l)
+}
+
+func defaultLogger() Logger {
+	return *std.Load().(*Logger)
 }
 
-func (d DebugLog) Printf(format string, args ...interface{}) {
-	if d {
-		log.Printf(format, args...)
+// WithLogger makes the server log to l.
+func WithLogger(l Logger) ServerOption {
+	return func(s *srv) error {
+		s.logBase = l
+		return nil
 	}
 }
 
-func (d DebugLog) Println(args ...interface{}) {
-	if d {
-		log.Println(args...)
+// component is the logger of a part of the package not bound to a
+// server, e.g. the exported codec functions, the resolvers, the session
+// sinks, the web ui and the agent. Its records go to the default logger
+// at the time they are written, the code serving a server logs to the
+// one given by WithLogger instead.
+type component string
+
+var (
+	aclLog      = component("acl")
+	agentLog    = component("agent")
+	authLog     = component("auth")
+	journalLog  = component("journal")
+	metricsLog  = component("metrics")
+	pipeLog     = component("pipe")
+	pluginLog   = component("plugin")
+	resolverLog = component("resolver")
+	sessionLog  = component("session")
+	ssLog       = component("ss")
+	tlvLog      = component("tlv")
+	tunnelLog   = component("tunnel")
+	udpLog      = component("udp")
+	webLog      = component("web")
+)
+
+func (c component) logger() Logger {
+	return defaultLogger().With("component", string(c))
+}
+
+func (c component) Enabled(level Level) bool {
+	return defaultLogger().Enabled(level)
+}
+
+func (c component) Debug(msg string, kv ...interface{}) {
+	if c.Enabled(LevelDebug) {
+		c.logger().Debug(msg, kv...)
+	}
+}
+
+func (c component) Info(msg string, kv ...interface{}) {
+	if c.Enabled(LevelInfo) {
+		c.logger().Info(msg, kv...)
 	}
 }
 
-func (d DebugLog) SetPrefix(prefix string) {
-	if d {
-		log.SetPrefix(prefix)
+func (c component) Error(msg string, kv ...interface{}) {
+	if c.Enabled(LevelError) {
+		c.logger().Error(msg, kv...)
 	}
 }
+
+func (c component) With(kv ...interface{}) Logger {
+	return c.logger().With(kv...)
+}
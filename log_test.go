@@ -0,0 +1,81 @@
+package proxy_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLoggerText(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLogger(&b, LevelInfo, TextFormat).With("component", "test")
+
+	l.Debug("hidden")
+	l.Info("connect failed", "target", "a:1", "err", errors.New("no route"), "odd")
+	got := b.String()
+	if strings.Contains(got, "hidden") {
+		t.Errorf("debug record should be dropped: %q", got)
+	}
+	expect := ` INFO connect failed component=test target=a:1 err="no route" odd=(MISSING)` + "\n"
+	if !strings.HasSuffix(got, expect) {
+		t.Errorf("expect suffix %q, but got %q", expect, got)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLogger(&b, LevelDebug, JSONFormat).With("component", "test")
+
+	l.Debug("handle request", "request", PushTask, "task", 3)
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("%s: %q", err, b.String())
+	}
+	for k, v := range map[string]interface{}{
+		"level":     "debug",
+		"msg":       "handle request",
+		"component": "test",
+		"request":   "PushTask",
+		"task":      float64(3),
+	} {
+		if got[k] != v {
+			t.Errorf("expect %s %v, but got %v", k, v, got[k])
+		}
+	}
+	if _, ok := got["time"]; !ok {
+		t.Error("record has no time")
+	}
+}
+
+func TestServerLogger(t *testing.T) {
+	var b bytes.Buffer
+	s, err := NewServer("", "", "", WithLogger(NewLogger(&b, LevelInfo, TextFormat)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	if err = s.handleRequest(&Request{Typ: TypeEnd}); err != unknownTypeErr {
+		t.Errorf("expect error %v, but got %v", unknownTypeErr, err)
+	}
+	expect := "ERROR unknown request type component=server request=" + TypeEnd.String()
+	if !strings.Contains(b.String(), expect) {
+		t.Errorf("expect %q in %q", expect, b.String())
+	}
+
+	// so do the records of the links
+	r, w := net.Pipe()
+	defer w.Close()
+	setTunnelConn(s, r)
+	go WriteTLV(w, TLV{T: tTaskID, L: 2, V: []byte{0, 1}})
+	if _, err = s.getCtrRequest(); err != badTaskHeaderErr {
+		t.Errorf("expect error %v, but got %v", badTaskHeaderErr, err)
+	}
+	expect = "ERROR task header is too short component=tunnel"
+	if !strings.Contains(b.String(), expect) {
+		t.Errorf("expect %q in %q", expect, b.String())
+	}
+}
@@ -0,0 +1,231 @@
+package proxy_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// metric is a family of counters or gauges told apart by their labels,
+// it is written in the prometheus text exposition format.
+type metric struct {
+	name string
+	help string
+	typ  string
+
+	lock sync.Mutex
+	// values by the rendered labels
+	vals map[string]float64
+}
+
+func newMetric(typ, name, help string) *metric {
+	return &metric{
+		name: name,
+		help: help,
+		typ:  typ,
+		vals: make(map[string]float64),
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString renders the label pairs in labels, e.g. k1, v1, k2, v2.
+func labelString(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	return b.String()
+}
+
+func (m *metric) add(v float64, labels ...string) {
+	k := labelString(labels)
+	m.lock.Lock()
+	m.vals[k] += v
+	m.lock.Unlock()
+}
+
+func (m *metric) set(v float64, labels ...string) {
+	k := labelString(labels)
+	m.lock.Lock()
+	m.vals[k] = v
+	m.lock.Unlock()
+}
+
+// del drops the value of labels.
+func (m *metric) del(labels ...string) {
+	k := labelString(labels)
+	m.lock.Lock()
+	delete(m.vals, k)
+	m.lock.Unlock()
+}
+
+func (m *metric) get(labels ...string) float64 {
+	k := labelString(labels)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.vals[k]
+}
+
+func (m *metric) write(w io.Writer) error {
+	m.lock.Lock()
+	keys := make([]string, 0, len(m.vals))
+	for k := range m.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	for _, k := range keys {
+		b.WriteString(m.name)
+		if k != "" {
+			b.WriteString("{" + k + "}")
+		}
+		b.WriteString(" " + strconv.FormatFloat(m.vals[k], 'g', -1, 64) + "\n")
+	}
+	m.lock.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var (
+	tlvMessages = newMetric("counter", "proxy_server_tlv_messages_total",
+		"TLV messages by link, direction and type.")
+	tunnelReconnects = newMetric("counter", "proxy_server_tunnel_reconnect_attempts_total",
+		"Reconnect attempts of the control tunnel.")
+	pingRTT = newMetric("gauge", "proxy_server_tunnel_ping_rtt_seconds",
+		"Round trip time of the last control tunnel ping, by vm.")
+	pingJitter = newMetric("gauge", "proxy_server_tunnel_ping_jitter_seconds",
+		"Jitter of the control tunnel pings, by vm.")
+	pingLoss = newMetric("gauge", "proxy_server_tunnel_ping_loss_ratio",
+		"Fraction of the control tunnel pings lost, by vm.")
+	activeConns = newMetric("gauge", "proxy_server_ss_connections",
+		"Active ss connections.")
+	pipedBytes = newMetric("counter", "proxy_server_piped_bytes_total",
+		"Bytes piped between the ss connections and their targets.")
+	splicedBytes = newMetric("counter", "proxy_server_spliced_bytes_total",
+		"Bytes piped by the kernel, between two plain tcp connections.")
+	dialErrors = newMetric("counter", "proxy_server_dial_errors_total",
+		"Dial errors by target host and reason.")
+	sessionTimeouts = newMetric("counter", "proxy_server_ss_session_timeouts_total",
+		"Ss sessions ended by a timeout, by cause.")
+	aclDenied = newMetric("counter", "proxy_server_acl_denied_total",
+		"Ss target addresses denied by the acl, by rule.")
+	dnsLookups = newMetric("counter", "proxy_server_dns_lookups_total",
+		"Lookups of the ss targets, by result.")
+
+	allMetrics = []*metric{
+		tlvMessages,
+		tunnelReconnects,
+		pingRTT,
+		pingJitter,
+		pingLoss,
+		activeConns,
+		pipedBytes,
+		splicedBytes,
+		dialErrors,
+		sessionTimeouts,
+		aclDenied,
+		dnsLookups,
+	}
+)
+
+func init() {
+	// the ones without labels are exposed from the start
+	for _, m := range []*metric{tunnelReconnects, activeConns, pipedBytes, splicedBytes} {
+		m.set(0)
+	}
+}
+
+func countTLV(link, direction string, t uint16) {
+	tlvMessages.add(1, "link", link, "direction", direction, "type", fmt.Sprintf("%#x", t))
+}
+
+// the dial errors are counted by 256 hosts at most, the other ones are
+// counted together
+var dialErrTargets = newTargetLabels(256)
+
+// targetLabels caps the hosts used as labels.
+type targetLabels struct {
+	max int
+
+	lock  sync.Mutex
+	hosts map[string]struct{}
+}
+
+func newTargetLabels(max int) *targetLabels {
+	return &targetLabels{max: max, hosts: make(map[string]struct{})}
+}
+
+// label returns the host of addr, "other" once there are max others.
+func (tl *targetLabels) label(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if _, ok := tl.hosts[host]; !ok {
+		if len(tl.hosts) >= tl.max {
+			return "other"
+		}
+		tl.hosts[host] = struct{}{}
+	}
+	return host
+}
+
+// countDialErr counts err of dialing addr by its host and reason.
+func countDialErr(addr string, err error) {
+	dialErrors.add(1, "target", dialErrTargets.label(addr), "reason", dialErrReason(err))
+}
+
+func dialErrReason(err error) string {
+	var de *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.As(err, &de):
+		return "dns"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
+
+// MetricsHandler serves the metrics of all the servers in the process.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range allMetrics {
+			if err := m.write(w); err != nil {
+				metricsLog.Debug("write metrics failed", "err", err)
+				return
+			}
+		}
+	})
+}
+
+// ServeMetrics serves MetricsHandler on /metrics of addr, it only
+// returns on failure.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	err := http.ListenAndServe(addr, mux)
+	metricsLog.Error("serve metrics failed", "addr", addr, "err", err)
+	return err
+}
@@ -0,0 +1,169 @@
+package proxy_server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMetricWrite(t *testing.T) {
+	m := newMetric("counter", "test_total", "Test counter.")
+	m.add(1, "target", "b:1")
+	m.add(2, "target", "a:1")
+	m.add(1, "target", "b:1")
+	m.add(1, "target", `"q"\`)
+
+	var b bytes.Buffer
+	if err := m.write(&b); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{target="\"q\"\\"} 1
+test_total{target="a:1"} 2
+test_total{target="b:1"} 2
+`
+	if b.String() != expect {
+		t.Errorf("expect:\n%s\nbut got:\n%s", expect, b.String())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	ts := httptest.NewServer(MetricsHandler())
+	defer ts.Close()
+
+	// the counters are global, only their changes are checked
+	tlvBefore := tlvMessages.get("link", "metrics", "direction", "out", "type", "0x3")
+	dialBefore := dialErrors.get("target", "metrics.test", "reason", "refused")
+
+	// a message written by a link writer is counted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, w := net.Pipe()
+	defer r.Close()
+	out := newLinkWriter(ctx, "metrics", w, NewTLVCodec(w), 1, QueueBlock, defaultLogger())
+	go out.run(make(chan error, 1))
+	// it is counted after written, the next message makes sure of it
+	for _, typ := range []uint16{3, 4} {
+		if err := out.put(TLV{T: typ, L: 0, V: []byte{}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadTLV(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countDialErr("metrics.test:80", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+	if got := tlvMessages.get("link", "metrics", "direction", "out", "type", "0x3") - tlvBefore; got != 1 {
+		t.Errorf("expect 1 message counted, but got %v", got)
+	}
+	if got := dialErrors.get("target", "metrics.test", "reason", "refused") - dialBefore; got != 1 {
+		t.Errorf("expect 1 dial error counted, but got %v", got)
+	}
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	for _, line := range []string{
+		"# TYPE proxy_server_tlv_messages_total counter",
+		`proxy_server_tlv_messages_total{link="metrics",direction="out",type="0x3"} `,
+		`proxy_server_dial_errors_total{target="metrics.test",reason="refused"} `,
+		"# TYPE proxy_server_tunnel_ping_rtt_seconds gauge",
+		"proxy_server_tunnel_reconnect_attempts_total ",
+		"proxy_server_ss_connections ",
+		"proxy_server_piped_bytes_total ",
+		"proxy_server_spliced_bytes_total ",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("expect %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestDialErrReason(t *testing.T) {
+	for name, c := range map[string]struct {
+		err    error
+		expect string
+	}{
+		"dns":         {err: &net.OpError{Op: "dial", Err: &net.DNSError{IsNotFound: true}}, expect: "dns"},
+		"timeout":     {err: &net.OpError{Op: "dial", Err: timeoutErr{}}, expect: "timeout"},
+		"refused":     {err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, expect: "refused"},
+		"unreachable": {err: &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, expect: "unreachable"},
+		"other":       {err: io.EOF, expect: "other"},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := dialErrReason(c.err); got != c.expect {
+				t.Errorf("expect %q, but got %q", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestDialErrTarget(t *testing.T) {
+	tl := newTargetLabels(1)
+	for _, c := range []struct{ addr, expect string }{
+		{"a.test:1", "a.test"},
+		{"a.test:2", "a.test"},
+		// over the cap
+		{"b.test:1", "other"},
+		{"[::1]:1", "other"},
+	} {
+		if got := tl.label(c.addr); got != c.expect {
+			t.Errorf("%s: expect %q, but got %q", c.addr, c.expect, got)
+		}
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	// the servers of a process don't overwrite the rtt of each other
+	rtts := map[string]time.Duration{"vm1": 250 * time.Millisecond, "vm2": 500 * time.Millisecond}
+	var servers []*srv
+	for vm, rtt := range rtts {
+		s, err := NewServer("", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.cancel()
+		s.pingVM = vm
+		servers = append(servers, s)
+
+		now := time.Now()
+		s.pingSent.Store(now)
+		s.lastRecvTime.Store(now.Add(rtt))
+		s.handleRequest(&Request{Typ: Ping})
+	}
+	for vm, rtt := range rtts {
+		if got := pingRTT.get("vm", vm); got != rtt.Seconds() {
+			t.Errorf("expect rtt %v of %s, but got %vs", rtt, vm, got)
+		}
+	}
+
+	// dropped once the tunnels stop
+	for _, s := range servers {
+		s.dropPingMetrics()
+	}
+	var b strings.Builder
+	pingRTT.write(&b)
+	if strings.Contains(b.String(), "vm1") || strings.Contains(b.String(), "vm2") {
+		t.Errorf("expect no rtt left, but got %q", b.String())
+	}
+}
@@ -0,0 +1,232 @@
+package proxy_server
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A ping to a vm speaking CapPingStats carries a sequence number and
+// the time it is sent, both are echoed in the ack:
+//
+//	tPing V = seq(4) | unix nanoseconds(8)
+//
+// The plugin is told the stats by pPingStats every pingReportEvery
+// pings:
+//
+//	pPingStats V = rtt(4) | average rtt(4) | jitter(4) | loss(2)
+//
+// in microseconds, the loss in per mille.
+const (
+	lenPing      = 4 + 8
+	lenPingStats = 4 + 4 + 4 + 2
+)
+
+var (
+	// the stats are computed over the last pingWindow pings
+	pingWindow = 32
+	// a ping without an ack in pingLossFactor * checkInterval is lost
+	pingLossFactor = 3
+	// the tunnel times out after missedPingLimit pings lost in a row
+	missedPingLimit = 3
+	pingReportEvery = 10
+
+	badPingErr = errors.New("malformed ping")
+)
+
+// PingStats is the latency of the control tunnel over the last pings.
+type PingStats struct {
+	// of the last acked ping
+	RTT    time.Duration
+	AvgRTT time.Duration
+	// mean difference between the rtts of consecutive pings
+	Jitter time.Duration
+	// fraction of the pings lost
+	Loss float64
+}
+
+func pingMessage(seq uint32, sent time.Time) []byte {
+	v := make([]byte, 0, lenPing)
+	v = binary.BigEndian.AppendUint32(v, seq)
+	return binary.BigEndian.AppendUint64(v, uint64(sent.UnixNano()))
+}
+
+// parsePing returns the sequence number of a ping ack, 0 if it has no
+// payload.
+func parsePing(l Logger, v []byte) (uint32, error) {
+	if len(v) == 0 {
+		return 0, nil
+	}
+	if len(v) < lenPing {
+		l.Error("ping is too short", "expect", lenPing, "len", len(v))
+		return 0, badPingErr
+	}
+	return binary.BigEndian.Uint32(v), nil
+}
+
+func usec(d time.Duration) uint32 {
+	return uint32(d / time.Microsecond)
+}
+
+func (p PingStats) marshal() []byte {
+	v := make([]byte, 0, lenPingStats)
+	v = binary.BigEndian.AppendUint32(v, usec(p.RTT))
+	v = binary.BigEndian.AppendUint32(v, usec(p.AvgRTT))
+	v = binary.BigEndian.AppendUint32(v, usec(p.Jitter))
+	return binary.BigEndian.AppendUint16(v, uint16(p.Loss*1000))
+}
+
+type pingSample struct {
+	seq   uint32
+	sent  time.Time
+	rtt   time.Duration
+	acked bool
+}
+
+// pingTracker keeps the last pings of the control tunnel, it is shared
+// by checkTunnel, Loop and the callers of PingStats.
+type pingTracker struct {
+	lock    sync.Mutex
+	seq     uint32
+	samples []pingSample
+}
+
+func (p *pingTracker) reset() {
+	p.lock.Lock()
+	p.samples = nil
+	p.lock.Unlock()
+}
+
+// send records a ping sent at now and returns its sequence number.
+func (p *pingTracker) send(now time.Time) uint32 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.seq++
+	if p.seq == 0 {
+		p.seq++
+	}
+	if len(p.samples) == pingWindow {
+		p.samples = p.samples[1:]
+	}
+	p.samples = append(p.samples, pingSample{seq: p.seq, sent: now})
+	return p.seq
+}
+
+// ack records the ack of ping seq received at now, it returns false if
+// the ping is unknown or acked already.
+func (p *pingTracker) ack(seq uint32, now time.Time) (time.Duration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i := range p.samples {
+		s := &p.samples[i]
+		if s.seq == seq && !s.acked {
+			s.acked = true
+			s.rtt = now.Sub(s.sent)
+			return s.rtt, true
+		}
+	}
+	return 0, false
+}
+
+func (s pingSample) lost(now time.Time) bool {
+	return !s.acked && now.Sub(s.sent) > time.Duration(pingLossFactor)*checkInterval
+}
+
+// missed returns the number of the last pings lost in a row.
+func (p *pingTracker) missed(now time.Time) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n := 0
+	for i := len(p.samples) - 1; i >= 0; i-- {
+		s := p.samples[i]
+		if s.acked {
+			break
+		}
+		if s.lost(now) {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *pingTracker) stats(now time.Time) PingStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var (
+		st               PingStats
+		acked, lost      int
+		sum, diffs, last time.Duration
+		hasLast          bool
+	)
+	for _, s := range p.samples {
+		if s.lost(now) {
+			lost++
+			continue
+		}
+		if !s.acked {
+			continue
+		}
+		acked++
+		sum += s.rtt
+		if hasLast {
+			d := s.rtt - last
+			if d < 0 {
+				d = -d
+			}
+			diffs += d
+		}
+		last, hasLast = s.rtt, true
+	}
+	if acked > 0 {
+		st.RTT = last
+		st.AvgRTT = sum / time.Duration(acked)
+	}
+	if acked > 1 {
+		st.Jitter = diffs / time.Duration(acked-1)
+	}
+	if acked+lost > 0 {
+		st.Loss = float64(lost) / float64(acked+lost)
+	}
+	return st
+}
+
+// PingStats returns the latency of the control tunnel, it is only
+// measured if the vm speaks CapPingStats.
+func (s *srv) PingStats() PingStats {
+	return s.pings.stats(time.Now())
+}
+
+// handlePingAck updates the stats with the ack in req.
+func (s *srv) handlePingAck(req *Request) {
+	if req.PingSeq == 0 {
+		// a legacy ack, it is received at lastRecvTime
+		sent, ok := s.pingSent.Load().(time.Time)
+		last, _ := s.lastRecvTime.Load().(time.Time)
+		if ok && last.After(sent) {
+			pingRTT.set(last.Sub(sent).Seconds(), "vm", s.pingVM)
+		}
+		return
+	}
+
+	rtt, ok := s.pings.ack(req.PingSeq, time.Now())
+	if !ok {
+		s.log.Debug("ack of ping is not expected", "seq", req.PingSeq)
+		return
+	}
+	st := s.pings.stats(time.Now())
+	pingRTT.set(rtt.Seconds(), "vm", s.pingVM)
+	pingJitter.set(st.Jitter.Seconds(), "vm", s.pingVM)
+	pingLoss.set(st.Loss, "vm", s.pingVM)
+}
+
+// dropPingMetrics drops the ping gauges of the tunnel, it stops.
+func (s *srv) dropPingMetrics() {
+	for _, m := range []*metric{pingRTT, pingJitter, pingLoss} {
+		m.del("vm", s.pingVM)
+	}
+}
@@ -0,0 +1,126 @@
+package proxy_server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPingTracker(t *testing.T) {
+	p := &pingTracker{}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if seq := p.send(start.Add(time.Duration(i) * time.Second)); seq != uint32(i+1) {
+			t.Fatalf("expect seq %d, but got %d", i+1, seq)
+		}
+	}
+	p.ack(1, start.Add(100*time.Millisecond))
+	p.ack(2, start.Add(time.Second+300*time.Millisecond))
+	if _, ok := p.ack(2, start.Add(2*time.Second)); ok {
+		t.Error("ping 2 should be acked once")
+	}
+
+	now := start.Add(2 * time.Second)
+	expect := PingStats{
+		RTT:    300 * time.Millisecond,
+		AvgRTT: 200 * time.Millisecond,
+		Jitter: 200 * time.Millisecond,
+	}
+	if got := p.stats(now); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect %#v, but got %#v", expect, got)
+	}
+	if n := p.missed(now); n != 0 {
+		t.Errorf("expect no missed ping, but got %d", n)
+	}
+
+	// ping 3 is lost at last
+	now = now.Add(time.Duration(pingLossFactor)*checkInterval + time.Second)
+	expect.Loss = 1.0 / 3
+	if got := p.stats(now); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect %#v, but got %#v", expect, got)
+	}
+	if n := p.missed(now); n != 1 {
+		t.Errorf("expect 1 missed ping, but got %d", n)
+	}
+}
+
+func TestPingStatsMarshal(t *testing.T) {
+	st := PingStats{
+		RTT:    time.Millisecond,
+		AvgRTT: 2 * time.Millisecond,
+		Jitter: 3 * time.Microsecond,
+		Loss:   0.25,
+	}
+	expect := []byte{0, 0, 0x3, 0xe8, 0, 0, 0x7, 0xd0, 0, 0, 0, 3, 0, 0xfa}
+	if got := st.marshal(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect %v, but got %v", expect, got)
+	}
+}
+
+func TestCheckTunnelPingStats(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.tunnelErr
+	defer s.cancel()
+
+	r, w := net.Pipe()
+	defer w.Close()
+	setTunnelConn(s, r)
+	s.tunnelFeat.Store(LocalFeatures)
+	s.tunnelCtx, s.tunnelCancel = context.WithCancel(s.ctx)
+	defer s.tunnelCancel()
+	// only the lost pings time out the tunnel
+	oldInterval, oldTimeout := checkInterval, checkTimeout
+	checkInterval, checkTimeout = 10*time.Millisecond, time.Hour
+	defer func() { checkInterval, checkTimeout = oldInterval, oldTimeout }()
+
+	s.tunnelWaiter.Add(1)
+	go s.checkTunnel()
+
+	acks := make(chan struct{})
+	go func() {
+		for i := 1; ; i++ {
+			req, err := GetCtrRequest(w)
+			if err != nil {
+				return
+			}
+			if req.Typ != Ping || req.PingSeq != uint32(i) {
+				t.Errorf("expect ping %d, but got %#v", i, req)
+				return
+			}
+			if i <= pingReportEvery {
+				s.handlePingAck(req)
+			}
+			if i == pingReportEvery {
+				close(acks)
+			}
+		}
+	}()
+
+	<-acks
+	select {
+	case req := <-s.reqs:
+		if req.Typ != TunnelPingStats || req.Stats.AvgRTT <= 0 {
+			t.Errorf("unexpected stats %#v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stats are reported")
+	}
+	if st := s.PingStats(); st.RTT <= 0 {
+		t.Errorf("unexpected stats %#v", st)
+	}
+
+	// no more acks
+	select {
+	case err = <-s.tunnelErr:
+		if err != tunnelTimeoutErr {
+			t.Fatalf("expect timeout, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel doesn't time out")
+	}
+}
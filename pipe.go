@@ -1,52 +1,285 @@
 package proxy_server
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
-	"time"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+var (
+	otaChunkErr  = errors.New("verify one time auth chunk failed")
+	halfCloseErr = errors.New("connection can't be half closed")
+)
+
+const (
+	lenOtaDataLen     = 2
+	lenOtaChunkHeader = lenOtaDataLen + lenHmacSha1
+	maxOtaDataLen     = 1<<16 - 1
+
+	pipeBufSize = 16 << 10
+	// a spliced pipe checks its shaper once a chunk
+	spliceChunk = 1 << 20
 )
 
-var readTimeout time.Duration
+// pipeResult is how a pipe ends: the bytes written to dst and the
+// error stopping it.
+type pipeResult struct {
+	n      int64
+	reason CloseReason
+	err    error
+}
 
-func setReadTimeout(c net.Conn) {
-	if readTimeout != 0 {
-		c.SetReadDeadline(time.Now().Add(readTimeout))
+func newPipeResult(n int64, rerr, werr error) pipeResult {
+	if werr != nil {
+		return pipeResult{n, closeReason(werr, true), werr}
 	}
+	return pipeResult{n, closeReason(rerr, false), rerr}
 }
 
 // PipeThenClose copies data from src to dst, closes dst when done.
 func PipeThenClose(src, dst net.Conn) {
+	copyConn(pipeLog, dst, src, nil, nil)
+	dst.Close()
+}
+
+// PipeThenCloseOta copies one time auth chunks from src to dst, closes
+// dst when done. Each chunk is framed as:
+// 2(data length) + 10(hmac-sha1 of data, keyed by iv + chunk id) + data
+// and only the data of a verified chunk is written to dst, the pipe
+// stops at the first mismatch.
+func PipeThenCloseOta(src otaConn, dst net.Conn) {
+	copyOta(pipeLog, dst, src, nil, nil)
+	dst.Close()
+}
+
+// relayResult is the bytes relayed from the client to the target (up)
+// and back (down), and the first error ending a direction, eof if none.
+type relayResult struct {
+	up, down int64
+	reason   CloseReason
+	err      error
+}
+
+// relay pipes client and target both ways until both directions are
+// done. The write side of a connection is closed once the other one
+// reaches eof, so that a peer which half closes still gets its answer,
+// the session is bounded by an idle timeout from then on. Both are
+// closed at the first error and at last. The timeouts of st apply to
+// both directions, the expired one is the result. The traffic from the
+// client is shaped by up, the one back by down.
+func relay(l Logger, client, target net.Conn, ota bool, st *sessionTimer, up, down shaper) relayResult {
+	var (
+		res  relayResult
+		lock sync.Mutex
+	)
+	end := func(r pipeResult, dst, src net.Conn) {
+		// before endHalf, the errors it causes come later
+		lock.Lock()
+		if res.reason == CloseEOF && r.reason != CloseEOF {
+			res.reason, res.err = r.reason, r.err
+		}
+		lock.Unlock()
+		endHalf(l, r, dst, src)
+		if r.reason == CloseEOF {
+			st.halfClose()
+		}
+	}
+
+	upc := make(chan pipeResult, 1)
+	go func() {
+		var r pipeResult
+		if ota {
+			r = copyOta(l, target, client.(otaConn), st, up)
+		} else {
+			r = copyConn(l, target, client, st, up)
+		}
+		end(r, target, client)
+		upc <- r
+	}()
+	r := copyConn(l, client, target, st, down)
+	end(r, client, target)
+	res.down = r.n
+	res.up = (<-upc).n
+	if reason, ok := st.stop(); ok {
+		res.reason, res.err = reason, nil
+	}
+
+	client.Close()
+	target.Close()
+	return res
+}
+
+// endHalf ends the direction from src to dst with result r: the write
+// side of dst is closed at eof, both are closed otherwise.
+func endHalf(l Logger, r pipeResult, dst, src net.Conn) {
+	if r.reason == CloseEOF {
+		err := closeWrite(dst)
+		if err == nil {
+			return
+		}
+		l.Debug("close write failed", "err", err)
+		// the peer only learns the eof once dst is closed
+		dst.Close()
+		return
+	}
+	dst.Close()
+	src.Close()
+}
+
+// closeWrite closes the write side of conn, the one of the connection
+// under a cipher for the encrypted ones.
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case *ss.Conn:
+		return closeWrite(c.Conn)
+	case *aeadConn:
+		return closeWrite(c.Conn)
+	}
+	return halfCloseErr
+}
+
+// copyConn copies src to dst until eof or an error, shaped by sh. Two
+// plain tcp connections, e.g. the ones of PipeThenClose, are spliced by
+// the kernel where it can, unless the reads are timed by st, and while
+// sh has no limit. The ss sessions are never spliced, their client side
+// is encrypted.
+func copyConn(l Logger, dst, src net.Conn, st *sessionTimer, sh shaper) pipeResult {
+	var total int64
+	if st.splice() {
+		if d, ok := dst.(*net.TCPConn); ok {
+			if s, ok := src.(*net.TCPConn); ok {
+				var (
+					r    pipeResult
+					done bool
+				)
+				if r, done = spliceConn(l, d, s, st, sh); done {
+					return r
+				}
+				total = r.n
+			}
+		}
+	}
+
 	var (
 		rerr, werr error
 		n          int
 	)
+	buf := getBuf(pipeBufSize)
 	defer func() {
+		putBuf(buf)
 		if rerr != nil {
-			Debug.Printf("[pipe]: read error: %s\n", rerr)
+			l.Debug("read failed", "err", rerr)
 		}
 		if werr != nil {
-			Debug.Printf("[pipe]: write error: %s\n", werr)
+			l.Debug("write failed", "err", werr)
 		}
-
-		dst.Close()
 	}()
 
-	buf := make([]byte, 4096)
 	for {
-		setReadTimeout(src)
+		st.beforeRead(src)
 		n, rerr = src.Read(buf)
+		st.touch()
 		// read may return EOF with n > 0
 		// should always process n > 0 bytes before handling error
 		if n > 0 {
 			// Note: avoid overwrite err returned by Read.
-			if _, werr = dst.Write(buf[0:n]); werr != nil {
-				return
+			var nw int
+			sh.wait(n)
+			nw, werr = dst.Write(buf[0:n])
+			total += int64(nw)
+			pipedBytes.add(float64(nw))
+			if werr != nil {
+				return newPipeResult(total, rerr, werr)
 			}
 		}
 		if rerr != nil {
 			// Always "use of closed network connection", but no easy way to
 			// identify this specific error. So just leave the error along for now.
 			// More info here: https://code.google.com/p/go/issues/detail?id=4373
-			break
+			return newPipeResult(total, rerr, nil)
+		}
+	}
+}
+
+// spliceConn copies src to dst with dst.ReadFrom, which splices them
+// on linux, a chunk at a time until sh gets a limit. It is done unless
+// the limit stops it, the rest is then copied by the caller. It doesn't
+// tell a read error from a write one, both are reported as read errors.
+func spliceConn(l Logger, dst, src *net.TCPConn, st *sessionTimer, sh shaper) (r pipeResult, done bool) {
+	for !sh.limited() {
+		lr := &io.LimitedReader{R: src, N: spliceChunk}
+		n, err := dst.ReadFrom(lr)
+		st.touch()
+		r.n += n
+		pipedBytes.add(float64(n))
+		splicedBytes.add(float64(n))
+		if err != nil {
+			l.Debug("splice failed", "err", err)
+		}
+		// src reached eof before the chunk is full
+		if err != nil || lr.N > 0 {
+			return newPipeResult(r.n, err, nil), true
+		}
+	}
+	return r, false
+}
+
+// copyOta copies the verified data of the one time auth chunks of src
+// to dst until eof, an error or the first mismatch.
+func copyOta(l Logger, dst net.Conn, src otaConn, st *sessionTimer, sh shaper) pipeResult {
+	var (
+		rerr, werr error
+		header     [lenOtaChunkHeader]byte
+		chunkId    [4]byte
+		total      int64
+	)
+	buf := getBuf(maxOtaDataLen)
+	defer func() {
+		putBuf(buf)
+		if rerr == otaChunkErr {
+			l.Error("verify ota chunk failed", "chunk", binary.BigEndian.Uint32(chunkId[:]))
+		} else if rerr != nil {
+			l.Debug("ota read failed", "err", rerr)
+		}
+		if werr != nil {
+			l.Debug("ota write failed", "err", werr)
+		}
+	}()
+
+	for {
+		st.beforeRead(src)
+		if _, rerr = io.ReadFull(src, header[:]); rerr != nil {
+			return newPipeResult(total, rerr, nil)
+		}
+		dataLen := int(binary.BigEndian.Uint16(header[:lenOtaDataLen]))
+		data := buf[:dataLen]
+		if _, rerr = io.ReadFull(src, data); rerr != nil {
+			return newPipeResult(total, rerr, nil)
+		}
+		st.touch()
+
+		binary.BigEndian.PutUint32(chunkId[:], src.GetAndIncrChunkId())
+		expect := header[lenOtaDataLen:]
+		actual := ss.HmacSha1(append(src.GetIv(), chunkId[:]...), data)
+		if !bytes.Equal(expect, actual) {
+			rerr = otaChunkErr
+			return newPipeResult(total, rerr, nil)
+		}
+
+		var nw int
+		sh.wait(len(data))
+		nw, werr = dst.Write(data)
+		total += int64(nw)
+		pipedBytes.add(float64(nw))
+		if werr != nil {
+			return newPipeResult(total, rerr, werr)
 		}
 	}
 }
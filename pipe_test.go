@@ -0,0 +1,174 @@
+package proxy_server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns the both ends of a tcp connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Log(err)
+		}
+		accepted <- conn
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// bufferedConn hides a *net.TCPConn, so that it is not spliced.
+type bufferedConn struct {
+	*net.TCPConn
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	for name, wrap := range map[string]func(*net.TCPConn) net.Conn{
+		"splice":   func(c *net.TCPConn) net.Conn { return c },
+		"buffered": func(c *net.TCPConn) net.Conn { return bufferedConn{c} },
+	} {
+		wrap := wrap
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client, relayClient := tcpPair(t)
+			relayTarget, target := tcpPair(t)
+			defer client.Close()
+			defer target.Close()
+
+			done := make(chan relayResult, 1)
+			go func() {
+				done <- relay(pipeLog, wrap(relayClient), wrap(relayTarget), false, nil, nil, nil)
+			}()
+
+			// the target answers once the request is done, like
+			// http/1.0
+			const request, response = "request", "response"
+			go func() {
+				got, err := io.ReadAll(target)
+				if err != nil || string(got) != request {
+					t.Errorf("expect request %q, but got %q, %v", request, got, err)
+				}
+				target.Write([]byte(response))
+				target.Close()
+			}()
+
+			client.Write([]byte(request))
+			client.CloseWrite()
+			got, err := io.ReadAll(client)
+			if err != nil || string(got) != response {
+				t.Errorf("expect response %q, but got %q, %v", response, got, err)
+			}
+
+			res := <-done
+			expect := relayResult{up: int64(len(request)), down: int64(len(response))}
+			if res != expect {
+				t.Errorf("expect %+v, but got %+v", expect, res)
+			}
+		})
+	}
+}
+
+func TestRelayError(t *testing.T) {
+	client, relayClient := tcpPair(t)
+	relayTarget, target := tcpPair(t)
+	defer client.Close()
+
+	done := make(chan relayResult, 1)
+	go func() {
+		done <- relay(pipeLog, relayClient, bufferedConn{relayTarget}, false, nil, nil, nil)
+	}()
+
+	// a reset target ends both directions
+	target.SetLinger(0)
+	target.Close()
+	res := <-done
+	if res.reason != CloseReadError || res.err == nil {
+		t.Errorf("expect read error, but got %+v", res)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect client is closed, but got %v", err)
+	}
+}
+
+func TestPipeThenCloseSplice(t *testing.T) {
+	for name, c := range map[string]struct {
+		wrap    func(*net.TCPConn) net.Conn
+		spliced bool
+	}{
+		"splice":   {wrap: func(c *net.TCPConn) net.Conn { return c }, spliced: true},
+		"buffered": {wrap: func(c *net.TCPConn) net.Conn { return bufferedConn{c} }},
+	} {
+		src, relaySrc := tcpPair(t)
+		relayDst, dst := tcpPair(t)
+		before := splicedBytes.get()
+
+		go PipeThenClose(c.wrap(relaySrc), c.wrap(relayDst))
+		data := bytes.Repeat([]byte{'x'}, 1<<20)
+		go func() {
+			src.Write(data)
+			src.Close()
+		}()
+		n, err := io.Copy(io.Discard, dst)
+		dst.Close()
+		relaySrc.Close()
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("%s: expect %d bytes, but got %d, %v", name, len(data), n, err)
+		}
+		// counted before dst is closed
+		expect := 0.0
+		if c.spliced {
+			expect = float64(len(data))
+		}
+		if got := splicedBytes.get() - before; got != expect {
+			t.Errorf("%s: expect %v bytes spliced, but got %v", name, expect, got)
+		}
+	}
+}
+
+func benchmarkRelay(b *testing.B, wrap func(*net.TCPConn) net.Conn) {
+	client, relayClient := tcpPair(b)
+	relayTarget, target := tcpPair(b)
+	defer client.Close()
+	defer target.Close()
+	go relay(pipeLog, wrap(relayClient), wrap(relayTarget), false, nil, nil, nil)
+
+	chunk := bytes.Repeat([]byte{'x'}, 32<<10)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.Write(chunk)
+		}
+		client.CloseWrite()
+	}()
+	n, err := io.Copy(io.Discard, target)
+	if err != nil || n != int64(b.N*len(chunk)) {
+		b.Fatalf("expect %d bytes, but got %d, %v", b.N*len(chunk), n, err)
+	}
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, func(c *net.TCPConn) net.Conn { return c })
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, func(c *net.TCPConn) net.Conn { return bufferedConn{c} })
+}
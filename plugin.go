@@ -3,7 +3,6 @@ package proxy_server
 import (
 	"errors"
 	"io"
-	"log"
 	"net"
 )
 
@@ -11,22 +10,36 @@ const (
 	pPushTaskRecv          = 0x1001
 	pPushTask              = 0x1002
 	pExit                  = 0x1003
+	pFeatures              = 0x1004
+	pPushTaskRecvID        = 0x1005
+	pPushTaskID            = 0x1006
 	pTaskResult            = 1
 	pTunnelReconnectFailed = 2
 	pTunnelConnectOk       = 3
+	pServerShutdown        = 4
+	pFeaturesAck           = 5
+	pTaskResultID          = 6
+	pTaskTimeout           = 7
+	pPingStats             = 8
+	pSessionRecord         = 9
 )
 
 var unknownTypeErr = errors.New("unknow type")
 
 func GetPluginRequest(r io.Reader) (*Request, error) {
-	tlv, err := ReadTLV(r)
+	return getPluginRequest(pluginLog, r)
+}
+
+func getPluginRequest(l Logger, r io.Reader) (*Request, error) {
+	tlv, err := readMessage(l, r)
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[plugin]: read request failed: %s\n", err)
+			l.Error("read request failed", "err", err)
 		}
 		return nil, err
 	}
+	countTLV("plugin", "in", tlv.T)
 
 	switch tlv.T {
 	case pPushTaskRecv:
@@ -39,36 +52,101 @@ func GetPluginRequest(r io.Reader) (*Request, error) {
 			Typ:      PushTask,
 			TaskData: tlv.V,
 		}, nil
+	case pPushTaskRecvID:
+		return parsePushTask(l, PushTaskRecv, tlv.V)
+	case pPushTaskID:
+		return parsePushTask(l, PushTask, tlv.V)
 	case pExit:
+		ReleaseTLV(tlv)
 		return &Request{Typ: Exit}, nil
+	case pFeatures:
+		f, err := unmarshalFeatures(l, tlv.V)
+		ReleaseTLV(tlv)
+		if err != nil {
+			return nil, err
+		}
+		return &Request{
+			Typ:      PluginFeatures,
+			Features: f,
+		}, nil
 	default:
-		log.Printf("[plugin]: unknow type[%#x]\n", tlv.T)
+		l.Error("unknown command type", "type", tlv.T)
 		return nil, unknownTypeErr
 	}
 }
 
-func PutPluginRequest(w io.Writer, req *Request) error {
+// PutPluginRequest writes req to a plugin speaking f, the request types
+// it doesn't support are refused.
+func PutPluginRequest(w io.Writer, req *Request, f Features) error {
+	tlv, err := encodePluginRequest(pluginLog, req, f)
+	if err != nil {
+		return err
+	}
+
+	err = WriteTLV(w, tlv)
+	if err != nil {
+		pluginLog.Error("write plugin request failed", "request", req.Typ, "err", err)
+	}
+	return err
+}
+
+// encodePluginRequest returns the message of req for a peer speaking f.
+func encodePluginRequest(l Logger, req *Request, f Features) (TLV, error) {
 	var tlv TLV
 	switch req.Typ {
 	case TaskResult:
 		tlv.T = pTaskResult
 		tlv.V = req.TaskData
+		if req.TaskID != 0 && f.Has(CapTaskID) {
+			tlv.T = pTaskResultID
+			tlv.V = taskMessage(req.TaskID, req.TaskData)
+		}
+	case TaskTimeout:
+		if err := f.require(CapTaskID); err != nil {
+			l.Debug("plugin doesn't support request", "request", req.Typ)
+			return tlv, err
+		}
+		tlv.T = pTaskTimeout
+		tlv.V = appendTaskID(nil, req.TaskID)
+	case TunnelPingStats:
+		if err := f.require(CapPingStats); err != nil {
+			l.Debug("plugin doesn't support request", "request", req.Typ)
+			return tlv, err
+		}
+		tlv.T = pPingStats
+		tlv.V = req.Stats.marshal()
+	case SessionEnd:
+		if err := f.require(CapSessionRecord); err != nil {
+			l.Debug("plugin doesn't support request", "request", req.Typ)
+			return tlv, err
+		}
+		tlv.T = pSessionRecord
+		tlv.V = req.Session.marshal()
 	case TunnelReconnectFailed:
 		tlv.T = pTunnelReconnectFailed
 		tlv.V = []byte{}
 	case TunnelConnectOk:
 		tlv.T = pTunnelConnectOk
 		tlv.V = []byte{}
+	case ServerShutdown:
+		if err := f.require(CapServerShutdown); err != nil {
+			l.Debug("plugin doesn't support request", "request", req.Typ)
+			return tlv, err
+		}
+		tlv.T = pServerShutdown
+		tlv.V = []byte{}
+	case PluginFeatures:
+		tlv.T = pFeaturesAck
+		tlv.V = req.Features.marshal()
 	default:
-		log.Printf("[plugin]: unknown type[%#x]\n", req.Typ)
-		return unknownTypeErr
+		l.Error("unknown request type", "request", req.Typ)
+		return tlv, unknownTypeErr
 	}
-	tlv.L = uint16(len(tlv.V))
-
-	err := WriteTLV(w, tlv)
-	if err != nil {
-		log.Printf("[plugin]: write plugin request[%#v] failed: %s\n",
-			req, err)
+	if err := fitsPeer(len(tlv.V), f); err != nil {
+		l.Error("request is too large for peer", "request", req.Typ, "len", len(tlv.V))
+		return tlv, err
 	}
-	return err
+	tlv.L = uint32(len(tlv.V))
+
+	return tlv, nil
 }
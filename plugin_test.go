@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetPluginRequest(t *testing.T) {
@@ -36,6 +37,34 @@ func TestGetPluginRequest(t *testing.T) {
 				Typ: Exit,
 			},
 		},
+		"Features": {
+			data: []byte{0x10, 0x04, 0, 7, 0, 1, 0, 0, 0, 1, 0xff},
+			expect: &Request{
+				Typ:      PluginFeatures,
+				Features: Features{Version: 1, Caps: CapServerShutdown},
+			},
+		},
+		"PushTaskID": {
+			data: []byte{0x10, 0x06, 0, 9, 0, 0, 0, 1, 0, 0, 0, 10, 3},
+			expect: &Request{
+				Typ:      PushTask,
+				TaskID:   1,
+				Timeout:  10 * time.Millisecond,
+				TaskData: []byte{3},
+			},
+		},
+		"PushTaskRecvID": {
+			data: []byte{0x10, 0x05, 0, 8, 0, 0, 0, 1, 0, 0, 0, 0},
+			expect: &Request{
+				Typ:      PushTaskRecv,
+				TaskID:   1,
+				TaskData: []byte{},
+			},
+		},
+		"shortFeatures": {
+			data:      []byte{0x10, 0x04, 0, 2, 0, 1},
+			expectErr: true,
+		},
 	} {
 		c := c
 		t.Run(name, func(t *testing.T) {
@@ -54,9 +83,10 @@ func TestGetPluginRequest(t *testing.T) {
 
 func TestPutPluginRequest(t *testing.T) {
 	for name, c := range map[string]struct {
-		data   *Request
-		err    error
-		expect []byte
+		data     *Request
+		features Features
+		err      error
+		expect   []byte
 	}{
 		"unknownType": {
 			data: &Request{Typ: 0xdead},
@@ -81,13 +111,106 @@ func TestPutPluginRequest(t *testing.T) {
 			},
 			expect: []byte{0, pTunnelConnectOk, 0, 0},
 		},
+		"ServerShutdown": {
+			data: &Request{
+				Typ: ServerShutdown,
+			},
+			features: Features{Version: 1, Caps: CapServerShutdown},
+			expect:   []byte{0, pServerShutdown, 0, 0},
+		},
+		"ServerShutdownLegacy": {
+			data: &Request{
+				Typ: ServerShutdown,
+			},
+			err: unsupportedErr,
+		},
+		"largeTask": {
+			data: &Request{
+				Typ:      TaskResult,
+				TaskData: make([]byte, maxShortLen+1),
+			},
+			features: Features{Version: 1, Caps: CapLargePayload},
+			expect: append([]byte{0x80, pTaskResult, 0, 1, 0, 0},
+				make([]byte, maxShortLen+1)...),
+		},
+		"taskWithID": {
+			data: &Request{
+				Typ:      TaskResult,
+				TaskID:   1,
+				TaskData: []byte{2},
+			},
+			features: Features{Version: 1, Caps: CapTaskID},
+			expect:   []byte{0, pTaskResultID, 0, 5, 0, 0, 0, 1, 2},
+		},
+		"taskWithIDLegacy": {
+			data: &Request{
+				Typ:      TaskResult,
+				TaskID:   1,
+				TaskData: []byte{2},
+			},
+			expect: []byte{0, pTaskResult, 0, 1, 2},
+		},
+		"TaskTimeout": {
+			data: &Request{
+				Typ:    TaskTimeout,
+				TaskID: 0x0102,
+			},
+			features: Features{Version: 1, Caps: CapTaskID},
+			expect:   []byte{0, pTaskTimeout, 0, 4, 0, 0, 1, 2},
+		},
+		"PingStats": {
+			data: &Request{
+				Typ:   TunnelPingStats,
+				Stats: PingStats{RTT: time.Millisecond, Loss: 0.5},
+			},
+			features: Features{Version: 1, Caps: CapPingStats},
+			expect:   []byte{0, pPingStats, 0, 14, 0, 0, 0x3, 0xe8, 0, 0, 0, 0, 0, 0, 0, 0, 0x1, 0xf4},
+		},
+		"PingStatsLegacy": {
+			data: &Request{
+				Typ: TunnelPingStats,
+			},
+			err: unsupportedErr,
+		},
+		"SessionRecord": {
+			data: &Request{
+				Typ: SessionEnd,
+				Session: SessionRecord{
+					Key:       "k",
+					Target:    "a:1",
+					Start:     time.Unix(0, 1),
+					End:       time.Unix(0, 2),
+					BytesUp:   3,
+					BytesDown: 4,
+					Reason:    CloseTimeout,
+				},
+			},
+			features: Features{Version: 1, Caps: CapSessionRecord},
+			expect: []byte{0, pSessionRecord, 0, 41,
+				0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2,
+				0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 4,
+				byte(CloseTimeout), 0, 1, 'k', 0, 3, 'a', ':', '1'},
+		},
+		"SessionRecordLegacy": {
+			data: &Request{
+				Typ: SessionEnd,
+			},
+			err: unsupportedErr,
+		},
+		"FeaturesAck": {
+			data: &Request{
+				Typ:      PluginFeatures,
+				Features: Features{Version: 1, Caps: CapServerShutdown},
+			},
+			expect: []byte{0, pFeaturesAck, 0, 6, 0, 1, 0, 0, 0, 1},
+		},
 	} {
 		c := c
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
 			var b bytes.Buffer
-			err := PutPluginRequest(&b, c.data)
+			err := PutPluginRequest(&b, c.data, c.features)
 			if err != c.err {
 				t.Errorf("expect error %v, but got %v", c.err, err)
 			}
@@ -0,0 +1,209 @@
+package proxy_server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Rate is a bandwidth in bytes per second, 0 means unlimited.
+type Rate struct {
+	// Up is from the clients to the targets, Down back
+	Up   int64
+	Down int64
+}
+
+// RateLimits shape the traffic relayed by the ss sessions.
+type RateLimits struct {
+	// Global is shared by all the sessions
+	Global Rate
+	// PerKey is shared by the sessions of a socket key
+	PerKey Rate
+}
+
+var (
+	// a bucket holds the tokens earned in rateBurst at most
+	rateBurst = 100 * time.Millisecond
+
+	badRateErr = errors.New("rate is negative")
+)
+
+func (l RateLimits) validate() error {
+	for _, r := range []int64{l.Global.Up, l.Global.Down, l.PerKey.Up, l.PerKey.Down} {
+		if r < 0 {
+			return badRateErr
+		}
+	}
+	return nil
+}
+
+// WithRateLimits shapes the ss sessions of the server by l.
+func WithRateLimits(l RateLimits) ServerOption {
+	return func(s *srv) error {
+		return s.SetRateLimits(l)
+	}
+}
+
+// SetRateLimits replaces the rate limits of the server, the running
+// sessions are shaped by the new ones from now on.
+func (s *srv) SetRateLimits(l RateLimits) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	s.limiter.set(l)
+	return nil
+}
+
+// tokenBucket earns rate tokens, i.e. bytes, per second. A taker may
+// run into debt, it waits until it is paid.
+type tokenBucket struct {
+	clock clock
+
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(c clock, rate int64) *tokenBucket {
+	b := &tokenBucket{clock: c, last: c.Now()}
+	b.setRate(rate)
+	b.tokens = b.burst()
+	return b
+}
+
+func (b *tokenBucket) burst() float64 {
+	return b.rate * rateBurst.Seconds()
+}
+
+// refill earns the tokens up to now, the caller holds lock.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += b.rate * elapsed.Seconds()
+		if burst := b.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(b.clock.Now())
+	b.rate = float64(rate)
+	if burst := b.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+func (b *tokenBucket) limited() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rate != 0
+}
+
+// wait takes n tokens, it returns once they are earned.
+func (b *tokenBucket) wait(n int) {
+	b.lock.Lock()
+	if b.rate == 0 {
+		b.lock.Unlock()
+		return
+	}
+	b.refill(b.clock.Now())
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if d > 0 {
+		<-b.clock.After(d)
+	}
+}
+
+// shaper is the buckets a direction of a session takes its tokens
+// from, the ones without a limit don't shape.
+type shaper []*tokenBucket
+
+// limited reports whether any bucket of sh has a limit now.
+func (sh shaper) limited() bool {
+	for _, b := range sh {
+		if b.limited() {
+			return true
+		}
+	}
+	return false
+}
+
+func (sh shaper) wait(n int) {
+	for _, b := range sh {
+		b.wait(n)
+	}
+}
+
+type keyBuckets struct {
+	up, down *tokenBucket
+	// sessions of the key
+	refs int
+}
+
+// rateLimiter keeps the buckets of a server, the ones of a socket key
+// live while it has sessions.
+type rateLimiter struct {
+	clock clock
+
+	lock     sync.Mutex
+	limits   RateLimits
+	up, down *tokenBucket
+	keys     map[string]*keyBuckets
+}
+
+func newRateLimiter(c clock) *rateLimiter {
+	return &rateLimiter{
+		clock: c,
+		up:    newTokenBucket(c, 0),
+		down:  newTokenBucket(c, 0),
+		keys:  make(map[string]*keyBuckets),
+	}
+}
+
+func (r *rateLimiter) set(l RateLimits) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.limits = l
+	r.up.setRate(l.Global.Up)
+	r.down.setRate(l.Global.Down)
+	for _, kb := range r.keys {
+		kb.up.setRate(l.PerKey.Up)
+		kb.down.setRate(l.PerKey.Down)
+	}
+}
+
+// acquire returns the shapers of a session of key, they follow the
+// limits set later, release it once the session ends.
+func (r *rateLimiter) acquire(key string) (up, down shaper) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	kb, ok := r.keys[key]
+	if !ok {
+		kb = &keyBuckets{
+			up:   newTokenBucket(r.clock, r.limits.PerKey.Up),
+			down: newTokenBucket(r.clock, r.limits.PerKey.Down),
+		}
+		r.keys[key] = kb
+	}
+	kb.refs++
+	return shaper{r.up, kb.up}, shaper{r.down, kb.down}
+}
+
+func (r *rateLimiter) release(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if kb, ok := r.keys[key]; ok {
+		if kb.refs--; kb.refs == 0 {
+			delete(r.keys, key)
+		}
+	}
+}
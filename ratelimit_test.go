@@ -0,0 +1,177 @@
+package proxy_server
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// virtualClock moves on by the delays it is asked for, so that the
+// waits return at once.
+type virtualClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newVirtualClock() *virtualClock {
+	return &virtualClock{now: time.Unix(0, 0)}
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	t := make(chan time.Time, 1)
+	t <- c.now
+	return t
+}
+
+// checkRate fails if n bytes in elapsed are not within 2% of rate.
+func checkRate(t *testing.T, n int64, elapsed time.Duration, rate int64) {
+	t.Helper()
+	got := float64(n) / elapsed.Seconds()
+	if math.Abs(got-float64(rate)) > float64(rate)*0.02 {
+		t.Errorf("expect rate %d, but got %.0f (%d bytes in %v)", rate, got, n, elapsed)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	for name, c := range map[string]struct {
+		rate  int64
+		chunk int
+	}{
+		"small":      {rate: 64 << 10, chunk: 1 << 10},
+		"largeChunk": {rate: 10 << 10, chunk: 16 << 10},
+		"fast":       {rate: 100 << 20, chunk: 16 << 10},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			clk := newVirtualClock()
+			b := newTokenBucket(clk, c.rate)
+			start := clk.Now()
+			var n int64
+			for clk.Now().Sub(start) < 10*time.Second {
+				b.wait(c.chunk)
+				n += int64(c.chunk)
+			}
+			checkRate(t, n, clk.Now().Sub(start), c.rate)
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clk := newVirtualClock()
+	r := newRateLimiter(clk)
+
+	take := func(sh shaper, d time.Duration) (int64, time.Duration) {
+		start := clk.Now()
+		var n int64
+		for clk.Now().Sub(start) < d {
+			sh.wait(1 << 10)
+			n += 1 << 10
+		}
+		return n, clk.Now().Sub(start)
+	}
+
+	// the unlimited directions are not shaped
+	up, down := r.acquire("a")
+	if up.limited() || down.limited() {
+		t.Error("expect no limit")
+	}
+	start := clk.Now()
+	up.wait(1 << 30)
+	if elapsed := clk.Now().Sub(start); elapsed != 0 {
+		t.Errorf("expect no wait, but got %v", elapsed)
+	}
+
+	// the per key limit is the lower one, even for the session started
+	// without a limit
+	r.set(RateLimits{Global: Rate{Up: 100 << 10}, PerKey: Rate{Up: 50 << 10, Down: 10 << 10}})
+	if !up.limited() || !down.limited() {
+		t.Error("expect the limits set later to apply")
+	}
+	n, elapsed := take(up, 10*time.Second)
+	checkRate(t, n, elapsed, 50<<10)
+	n, elapsed = take(down, 10*time.Second)
+	checkRate(t, n, elapsed, 10<<10)
+
+	// adjusted at runtime, the global limit is the lower one now
+	r.set(RateLimits{Global: Rate{Up: 20 << 10}, PerKey: Rate{Up: 50 << 10}})
+	n, elapsed = take(up, 10*time.Second)
+	checkRate(t, n, elapsed, 20<<10)
+
+	// the sessions of a key share its buckets
+	up2, _ := r.acquire("a")
+	if up2[1] != up[1] {
+		t.Error("sessions of a key should share its bucket")
+	}
+	up3, _ := r.acquire("b")
+	if up3[1] == up[1] || up3[0] != up[0] {
+		t.Error("keys should only share the global bucket")
+	}
+	// lifting the limits stops the shaping
+	r.set(RateLimits{})
+	if up.limited() || down.limited() {
+		t.Error("expect no limit")
+	}
+
+	r.release("a")
+	r.release("a")
+	r.release("b")
+	if len(r.keys) != 0 {
+		t.Errorf("expect no key left, but got %d", len(r.keys))
+	}
+}
+
+func TestRelayRateLimit(t *testing.T) {
+	const rate = 1 << 20
+	for name, later := range map[string]bool{
+		"limited": false,
+		// the session starts spliced, the limit stops it
+		"limitedLater": true,
+	} {
+		clk := newVirtualClock()
+		r := newRateLimiter(clk)
+		if !later {
+			r.set(RateLimits{Global: Rate{Up: rate}})
+		}
+		up, down := r.acquire("k")
+
+		client, relayClient := tcpPair(t)
+		relayTarget, target := tcpPair(t)
+		before := splicedBytes.get()
+		go relay(pipeLog, relayClient, relayTarget, false, nil, up, down)
+		if later {
+			r.set(RateLimits{Global: Rate{Up: rate}})
+		}
+
+		data := bytes.Repeat([]byte{'x'}, 8<<20)
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		start := clk.Now()
+		n, err := io.Copy(io.Discard, target)
+		target.Close()
+		r.release("k")
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("%s: expect %d bytes, but got %d, %v", name, len(data), n, err)
+		}
+		spliced := int64(splicedBytes.get() - before)
+		if spliced > spliceChunk {
+			t.Errorf("%s: expect %d bytes spliced at most, but got %d", name, spliceChunk, spliced)
+		}
+		checkRate(t, n-spliced, clk.Now().Sub(start), rate)
+	}
+}
@@ -0,0 +1,113 @@
+package proxy_server
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// clock is the source of time of the reconnect logic and the rate
+// limits, tests replace it.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ReconnectPolicy describes how the control tunnel is reconnected:
+// the n-th retry waits InitialDelay * Multiplier^(n-1), capped by
+// MaxDelay, then randomized by +/- Jitter (a fraction of the delay).
+// MaxAttempts limits the number of retries, 0 means retry forever.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	Jitter       float64
+	MaxAttempts  int
+}
+
+var (
+	DefaultReconnectPolicy = ReconnectPolicy{
+		InitialDelay: 1 * time.Second,
+		Multiplier:   2,
+		MaxDelay:     1 * time.Minute,
+		Jitter:       0.2,
+	}
+
+	invalidPolicyErr = errors.New("invalid reconnect policy")
+)
+
+func (p ReconnectPolicy) validate() error {
+	if p.InitialDelay <= 0 || p.MaxDelay < p.InitialDelay ||
+		p.Multiplier < 1 || p.Jitter < 0 || p.Jitter > 1 || p.MaxAttempts < 0 {
+		return invalidPolicyErr
+	}
+	return nil
+}
+
+// WithReconnectPolicy sets the policy used to reconnect the control
+// tunnel, DefaultReconnectPolicy is used otherwise.
+func WithReconnectPolicy(p ReconnectPolicy) ServerOption {
+	return func(s *srv) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		s.backoff = newBackoff(p)
+		return nil
+	}
+}
+
+// backoff keeps the state of a reconnect policy during an outage.
+type backoff struct {
+	policy   ReconnectPolicy
+	rand     func() float64
+	attempts int
+	delay    time.Duration
+}
+
+func newBackoff(p ReconnectPolicy) *backoff {
+	return &backoff{
+		policy: p,
+		rand:   rand.Float64,
+	}
+}
+
+// Next returns the delay before the next retry, false if all the
+// attempts are used up.
+func (b *backoff) Next() (time.Duration, bool) {
+	p := b.policy
+	if p.MaxAttempts > 0 && b.attempts >= p.MaxAttempts {
+		return 0, false
+	}
+	b.attempts++
+
+	if b.delay == 0 {
+		b.delay = p.InitialDelay
+	} else {
+		b.delay = time.Duration(float64(b.delay) * p.Multiplier)
+		if b.delay > p.MaxDelay {
+			b.delay = p.MaxDelay
+		}
+	}
+
+	d := b.delay
+	if p.Jitter > 0 {
+		// uniform in [d - jitter*d, d + jitter*d)
+		d += time.Duration((2*b.rand() - 1) * p.Jitter * float64(d))
+	}
+	return d, true
+}
+
+// Reset starts over, it is called once the tunnel is back.
+func (b *backoff) Reset() {
+	b.attempts = 0
+	b.delay = 0
+}
+
+func (b *backoff) Attempts() int {
+	return b.attempts
+}
@@ -0,0 +1,234 @@
+package proxy_server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock hands the requested delays to the test, which fires them
+// by hand.
+type fakeClock struct {
+	afters chan fakeTimer
+}
+
+type fakeTimer struct {
+	d time.Duration
+	c chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{afters: make(chan fakeTimer, 16)}
+}
+
+// Now is the real time, the delays are only fired by hand.
+func (c *fakeClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	t := fakeTimer{d: d, c: make(chan time.Time, 1)}
+	c.afters <- t
+	return t.c
+}
+
+func (c *fakeClock) next(t *testing.T) fakeTimer {
+	select {
+	case ft := <-c.afters:
+		return ft
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timer is requested")
+	}
+	return fakeTimer{}
+}
+
+func TestBackoff(t *testing.T) {
+	for name, c := range map[string]struct {
+		policy ReconnectPolicy
+		rand   float64
+		expect []time.Duration
+	}{
+		"exponential": {
+			policy: ReconnectPolicy{InitialDelay: 1 * time.Second, Multiplier: 2, MaxDelay: 5 * time.Second},
+			expect: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		"maxAttempts": {
+			policy: ReconnectPolicy{InitialDelay: 1 * time.Second, Multiplier: 3, MaxDelay: time.Minute, MaxAttempts: 2},
+			expect: []time.Duration{1 * time.Second, 3 * time.Second},
+		},
+		"jitterLow": {
+			policy: ReconnectPolicy{InitialDelay: 1 * time.Second, Multiplier: 2, MaxDelay: time.Minute, Jitter: 0.5},
+			rand:   0,
+			expect: []time.Duration{500 * time.Millisecond, 1 * time.Second},
+		},
+		"jitterHigh": {
+			policy: ReconnectPolicy{InitialDelay: 1 * time.Second, Multiplier: 2, MaxDelay: time.Minute, Jitter: 0.5},
+			rand:   0.75,
+			expect: []time.Duration{1250 * time.Millisecond, 2500 * time.Millisecond},
+		},
+	} {
+		b := newBackoff(c.policy)
+		b.rand = func() float64 { return c.rand }
+
+		for round := 0; round < 2; round++ {
+			var got []time.Duration
+			for len(got) < len(c.expect) {
+				d, ok := b.Next()
+				if !ok {
+					break
+				}
+				got = append(got, d)
+			}
+			if !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("%s(round %d): expect %v, but got %v", name, round, c.expect, got)
+			}
+			if _, ok := b.Next(); c.policy.MaxAttempts > 0 && ok {
+				t.Errorf("%s(round %d): expect to give up", name, round)
+			}
+			b.Reset()
+		}
+	}
+}
+
+func TestReconnectPolicyValidate(t *testing.T) {
+	for name, c := range map[string]struct {
+		policy    ReconnectPolicy
+		shouldErr bool
+	}{
+		"default":         {policy: DefaultReconnectPolicy},
+		"noInitialDelay":  {policy: ReconnectPolicy{Multiplier: 2, MaxDelay: time.Second}, shouldErr: true},
+		"smallMaxDelay":   {policy: ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: time.Millisecond}, shouldErr: true},
+		"smallMultiplier": {policy: ReconnectPolicy{InitialDelay: time.Second, Multiplier: 0.5, MaxDelay: time.Second}, shouldErr: true},
+		"bigJitter":       {policy: ReconnectPolicy{InitialDelay: time.Second, Multiplier: 1, MaxDelay: time.Second, Jitter: 2}, shouldErr: true},
+	} {
+		_, err := NewServer("", "", "", WithReconnectPolicy(c.policy))
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%s: expect error %v, but got %v", name, c.shouldErr, err)
+		}
+	}
+}
+
+func TestReconnectTunnel(t *testing.T) {
+	policy := ReconnectPolicy{
+		InitialDelay: 1 * time.Second,
+		Multiplier:   2,
+		MaxDelay:     time.Minute,
+		MaxAttempts:  2,
+	}
+	s, err := NewServer("", "", "", WithReconnectPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	clk := newFakeClock()
+	s.clock = clk
+	r, w := net.Pipe()
+	setPluginConn(s, w)
+	s.tunnelAddr = "127.0.0.1:1"
+	go s.Loop()
+
+	// the first failure is reported
+	expect := TLV{T: pTunnelReconnectFailed, L: 0, V: []byte{}}
+	got, err := ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+	ft := clk.next(t)
+	if ft.d != policy.InitialDelay {
+		t.Errorf("expect delay %s, but got %s", policy.InitialDelay, ft.d)
+	}
+
+	// requests are still handled while waiting
+	s.reqs <- &Request{Typ: TaskResult, TaskData: []byte("foo")}
+	expect = TLV{T: pTaskResult, L: 3, V: []byte("foo")}
+	got, err = ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+
+	// retry fails again, the delay grows
+	ft.c <- time.Now()
+	ft = clk.next(t)
+	if expect := 2 * policy.InitialDelay; ft.d != expect {
+		t.Errorf("expect delay %s, but got %s", expect, ft.d)
+	}
+
+	// the tunnel is back at the last retry
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s.linkLock.Lock()
+	s.tunnelAddr = l.Addr().String()
+	s.linkLock.Unlock()
+	ft.c <- time.Now()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect = TLV{T: pTunnelConnectOk, L: 0, V: []byte{}}
+	got, err = ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+	select {
+	case ft = <-clk.afters:
+		t.Errorf("unexpected retry in %s", ft.d)
+	default:
+	}
+}
+
+func TestReconnectTunnelBlackholed(t *testing.T) {
+	// the vm accepts but never answers the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	s, err := NewServer("", l.Addr().String(), "", WithControlAuth("srv1", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	r, w := net.Pipe()
+	setPluginConn(s, w)
+	go s.Loop()
+	conn := <-accepted
+	defer conn.Close()
+
+	// Loop still handles the requests while dialing
+	s.reqs <- &Request{Typ: TaskResult, TaskData: []byte("foo")}
+	expect := TLV{T: pTaskResult, L: 3, V: []byte("foo")}
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+}
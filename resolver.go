@@ -0,0 +1,223 @@
+package proxy_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResolverConfig describes a Resolver, the zero one resolves with the
+// system resolver and doesn't cache.
+type ResolverConfig struct {
+	// Servers are the upstream dns servers, host:port, the system ones
+	// if empty. They are queried in turn.
+	Servers []string
+	// Network of the servers, "udp" (default) or "tcp", a truncated
+	// answer over udp is asked again over tcp
+	Network string
+	// TTL of the addresses found, NegativeTTL of the domains not found,
+	// 0 doesn't cache them
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// Hosts are the static addresses of domains, they override the
+	// servers and never expire
+	Hosts map[string][]net.IP
+	// Prefer is "ipv4" or "ipv6", the addresses of which come first
+	Prefer string
+}
+
+// Resolver resolves the targets of the ss sessions.
+type Resolver struct {
+	c        ResolverConfig
+	resolver *net.Resolver
+	// index of the next server
+	next uint32
+
+	lock  sync.Mutex
+	cache map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+var (
+	// the cache holds maxDNSEntries domains at most
+	maxDNSEntries = 4096
+	// a lookup gives up after lookupTimeout
+	lookupTimeout = 5 * time.Second
+
+	badResolverErr = errors.New("bad resolver config")
+)
+
+// NewResolver returns a resolver described by c.
+func NewResolver(c ResolverConfig) (*Resolver, error) {
+	switch c.Network {
+	case "":
+		c.Network = "udp"
+	case "udp", "tcp":
+	default:
+		resolverLog.Error("bad network", "network", c.Network)
+		return nil, badResolverErr
+	}
+	switch c.Prefer {
+	case "", "ipv4", "ipv6":
+	default:
+		resolverLog.Error("bad preference", "prefer", c.Prefer)
+		return nil, badResolverErr
+	}
+	if c.TTL < 0 || c.NegativeTTL < 0 {
+		return nil, badTimeoutErr
+	}
+	for _, s := range c.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			resolverLog.Error("bad server", "server", s, "err", err)
+			return nil, badResolverErr
+		}
+	}
+	hosts := make(map[string][]net.IP, len(c.Hosts))
+	for h, ips := range c.Hosts {
+		hosts[canonicalDomain(h)] = ips
+	}
+	c.Hosts = hosts
+
+	r := &Resolver{
+		c:        c,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]*dnsEntry),
+	}
+	if len(c.Servers) > 0 {
+		r.resolver = &net.Resolver{PreferGo: true, Dial: r.dial}
+	}
+	return r, nil
+}
+
+// dial connects to the next server, whichever the system one asked.
+// The go resolver asks tcp for a truncated answer, and speaks tcp on a
+// connection which is not a packet one.
+func (r *Resolver) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	if r.c.Network == "tcp" {
+		network = "tcp"
+	}
+	i := atomic.AddUint32(&r.next, 1) - 1
+	server := r.c.Servers[int(i)%len(r.c.Servers)]
+	var d net.Dialer
+	return d.DialContext(ctx, network, server)
+}
+
+func canonicalDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// LookupIP returns the addresses of host, in the preferred order. A
+// nil resolver is the system one without cache.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if r == nil {
+		return lookupIP(ctx, net.DefaultResolver, host)
+	}
+
+	host = canonicalDomain(host)
+	if ips, ok := r.c.Hosts[host]; ok {
+		dnsLookups.add(1, "result", "hosts")
+		return r.order(ips), nil
+	}
+
+	now := time.Now()
+	r.lock.Lock()
+	e, ok := r.cache[host]
+	r.lock.Unlock()
+	if ok && now.Before(e.expires) {
+		dnsLookups.add(1, "result", "cached")
+		return e.ips, e.err
+	}
+
+	ips, err := lookupIP(ctx, r.resolver, host)
+	var ttl time.Duration
+	switch {
+	case err == nil:
+		dnsLookups.add(1, "result", "found")
+		ips = r.order(ips)
+		ttl = r.c.TTL
+	case isNotFound(err):
+		dnsLookups.add(1, "result", "not_found")
+		ttl = r.c.NegativeTTL
+	default:
+		dnsLookups.add(1, "result", "error")
+		resolverLog.Debug("lookup failed", "host", host, "err", err)
+	}
+	if ttl > 0 {
+		r.store(host, &dnsEntry{ips: ips, err: err, expires: now.Add(ttl)})
+	}
+	return ips, err
+}
+
+// lookupIP looks host up by res, in lookupTimeout at most.
+func lookupIP(ctx context.Context, res *net.Resolver, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	addrs, err := res.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+func isNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
+
+func (r *Resolver) store(host string, e *dnsEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.cache) >= maxDNSEntries {
+		now := time.Now()
+		for h, old := range r.cache {
+			if !now.Before(old.expires) {
+				delete(r.cache, h)
+			}
+		}
+	}
+	// still full, drop any
+	for h := range r.cache {
+		if len(r.cache) < maxDNSEntries {
+			break
+		}
+		delete(r.cache, h)
+	}
+	r.cache[host] = e
+}
+
+// order returns a copy of ips, the preferred family first.
+func (r *Resolver) order(ips []net.IP) []net.IP {
+	ips = append([]net.IP(nil), ips...)
+	if r.c.Prefer == "" {
+		return ips
+	}
+	v4First := r.c.Prefer == "ipv4"
+	sort.SliceStable(ips, func(i, j int) bool {
+		a, b := ips[i].To4() != nil, ips[j].To4() != nil
+		return a != b && a == v4First
+	})
+	return ips
+}
+
+// WithResolver makes the ss sessions of the server resolve their
+// targets by r.
+func WithResolver(r *Resolver) ServerOption {
+	return func(s *srv) error {
+		s.resolver = r
+		return nil
+	}
+}
@@ -0,0 +1,426 @@
+package proxy_server
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// dnsStub answers the A and AAAA queries of the domains in records, the
+// other domains are not found. It serves udp and tcp on the same port,
+// the answers of the domains under "truncated." are truncated over udp.
+type dnsStub struct {
+	records map[string][]net.IP
+	udp     net.PacketConn
+	tcp     net.Listener
+
+	lock sync.Mutex
+	// queries by domain and network
+	queries map[string]int
+}
+
+func newDNSStub(t *testing.T, records map[string][]net.IP) *dnsStub {
+	var (
+		udp net.PacketConn
+		tcp net.Listener
+		err error
+	)
+	// the tcp port may be taken already, try another one
+	for i := 0; i < 10; i++ {
+		udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tcp, err = net.Listen("tcp", udp.LocalAddr().String()); err == nil {
+			break
+		}
+		udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsStub{records: records, udp: udp, tcp: tcp, queries: make(map[string]int)}
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	return s
+}
+
+func (s *dnsStub) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *dnsStub) count(domain, network string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queries[domain+"/"+network]
+}
+
+func (s *dnsStub) serveUDP() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n], "udp"); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnsStub) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var l [2]byte
+				if _, err := io.ReadFull(conn, l[:]); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				resp := s.answer(msg, "tcp")
+				if resp == nil {
+					return
+				}
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}
+		}()
+	}
+}
+
+// answer returns the response of the query msg, nil if it is malformed.
+func (s *dnsStub) answer(msg []byte, network string) []byte {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil
+	}
+	// the question: labels, type and class
+	var labels []string
+	i := 12
+	for i < len(msg) && msg[i] != 0 {
+		l := int(msg[i])
+		if i+1+l > len(msg) {
+			return nil
+		}
+		labels = append(labels, string(msg[i+1:i+1+l]))
+		i += 1 + l
+	}
+	if i+5 > len(msg) {
+		return nil
+	}
+	question := msg[12 : i+5]
+	qtype := binary.BigEndian.Uint16(msg[i+1:])
+	domain := strings.ToLower(strings.Join(labels, "."))
+
+	s.lock.Lock()
+	s.queries[domain+"/"+network]++
+	s.lock.Unlock()
+
+	ips, found := s.records[domain]
+	truncated := network == "udp" && strings.HasPrefix(domain, "truncated.")
+	if truncated {
+		ips = nil
+	}
+	var answers [][]byte
+	for _, ip := range ips {
+		rdata, typ := []byte(ip.To4()), uint16(dnsTypeA)
+		if rdata == nil {
+			rdata, typ = []byte(ip.To16()), dnsTypeAAAA
+		}
+		if typ != qtype {
+			continue
+		}
+		// a pointer to the question name, type, class IN, ttl 60
+		a := []byte{0xc0, 12}
+		a = binary.BigEndian.AppendUint16(a, typ)
+		a = binary.BigEndian.AppendUint16(a, 1)
+		a = binary.BigEndian.AppendUint32(a, 60)
+		a = binary.BigEndian.AppendUint16(a, uint16(len(rdata)))
+		answers = append(answers, append(a, rdata...))
+	}
+
+	// response, authoritative, recursion desired and available
+	flags := uint16(0x8000 | 0x0400 | 0x0080 | binary.BigEndian.Uint16(msg[2:])&0x0100)
+	if !found {
+		flags |= 3 // NXDOMAIN
+	}
+	if truncated {
+		flags |= 0x0200
+	}
+	resp := append([]byte(nil), msg[:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	return resp
+}
+
+func TestResolver(t *testing.T) {
+	stub := newDNSStub(t, map[string][]net.IP{
+		"a.test":    {net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1")},
+		"tcp.test":  {net.ParseIP("1.2.3.5")},
+		"ipv6.test": {net.ParseIP("2001:db8::2")},
+
+		"truncated.test": {net.ParseIP("1.2.3.6")},
+	})
+
+	for name, c := range map[string]struct {
+		config  ResolverConfig
+		host    string
+		network string
+		expect  []string
+		found   bool
+	}{
+		"preferIPv4": {
+			config:  ResolverConfig{Prefer: "ipv4"},
+			host:    "a.test",
+			network: "udp",
+			expect:  []string{"1.2.3.4", "2001:db8::1"},
+			found:   true,
+		},
+		"preferIPv6": {
+			config:  ResolverConfig{Prefer: "ipv6"},
+			host:    "A.Test.",
+			network: "udp",
+			expect:  []string{"2001:db8::1", "1.2.3.4"},
+			found:   true,
+		},
+		"tcp": {
+			config:  ResolverConfig{Network: "tcp"},
+			host:    "tcp.test",
+			network: "tcp",
+			expect:  []string{"1.2.3.5"},
+			found:   true,
+		},
+		"truncated": {
+			host:    "truncated.test",
+			network: "tcp",
+			expect:  []string{"1.2.3.6"},
+			found:   true,
+		},
+		"ipv6Only": {
+			config:  ResolverConfig{Prefer: "ipv4"},
+			host:    "ipv6.test",
+			network: "udp",
+			expect:  []string{"2001:db8::2"},
+			found:   true,
+		},
+		"notFound": {
+			host:    "missing.test",
+			network: "udp",
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			c.config.Servers = []string{stub.addr()}
+			r, err := NewResolver(c.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := stub.count(canonicalDomain(c.host), c.network)
+
+			ips, err := r.LookupIP(context.Background(), c.host)
+			if c.found != (err == nil) {
+				t.Fatalf("expect found %t, but got error %v", c.found, err)
+			}
+			if !c.found && !isNotFound(err) {
+				t.Errorf("expect not found, but got %v", err)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("expect %v, but got %v", c.expect, got)
+			}
+			if stub.count(canonicalDomain(c.host), c.network) == before {
+				t.Errorf("stub is not queried over %s", c.network)
+			}
+		})
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	stub := newDNSStub(t, map[string][]net.IP{
+		"a.test": {net.ParseIP("1.2.3.4")},
+	})
+
+	for name, c := range map[string]struct {
+		config ResolverConfig
+		host   string
+		// queries of the host after two lookups
+		expect int
+	}{
+		"noCache": {
+			host:   "a.test",
+			expect: 2,
+		},
+		"positive": {
+			config: ResolverConfig{TTL: time.Minute},
+			host:   "a.test",
+			expect: 1,
+		},
+		"positiveExpired": {
+			config: ResolverConfig{TTL: time.Nanosecond},
+			host:   "a.test",
+			expect: 2,
+		},
+		"negative": {
+			config: ResolverConfig{NegativeTTL: time.Minute},
+			host:   "missing.test",
+			expect: 1,
+		},
+		"negativeOnly": {
+			config: ResolverConfig{NegativeTTL: time.Minute},
+			host:   "a.test",
+			expect: 2,
+		},
+		"hosts": {
+			config: ResolverConfig{Hosts: map[string][]net.IP{"A.test": {net.ParseIP("9.9.9.9")}}},
+			host:   "a.test",
+			expect: 0,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			c.config.Servers = []string{stub.addr()}
+			r, err := NewResolver(c.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := stub.count(c.host, "udp")
+
+			for i := 0; i < 2; i++ {
+				time.Sleep(time.Millisecond)
+				ips, err := r.LookupIP(context.Background(), c.host)
+				if _, ok := stub.records[c.host]; ok || c.expect == 0 {
+					if err != nil || len(ips) == 0 {
+						t.Fatalf("unexpected result %v, %v", ips, err)
+					}
+				} else if !isNotFound(err) {
+					t.Fatalf("expect not found, but got %v", err)
+				}
+			}
+			// a lookup queries a and aaaa
+			got := stub.count(c.host, "udp") - before
+			if got != 2*c.expect {
+				t.Errorf("expect %d lookups, but got %d queries", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestResolverTimeout(t *testing.T) {
+	// a server which never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	old := lookupTimeout
+	lookupTimeout = 50 * time.Millisecond
+	defer func() { lookupTimeout = old }()
+
+	r, err := NewResolver(ResolverConfig{Servers: []string{pc.LocalAddr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = r.LookupIP(context.Background(), "a.test"); err == nil {
+		t.Error("lookup should fail")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expect lookup to give up in %s, but it takes %s", lookupTimeout, d)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	for name, c := range map[string]struct {
+		config ResolverConfig
+		err    error
+	}{
+		"zero":        {},
+		"badNetwork":  {config: ResolverConfig{Network: "quic"}, err: badResolverErr},
+		"badPrefer":   {config: ResolverConfig{Prefer: "ipv5"}, err: badResolverErr},
+		"badServer":   {config: ResolverConfig{Servers: []string{"8.8.8.8"}}, err: badResolverErr},
+		"negativeTTL": {config: ResolverConfig{TTL: -time.Second}, err: badTimeoutErr},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := NewResolver(c.config); err != c.err {
+				t.Errorf("expect error %v, but got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestDialTargetResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	stub := newDNSStub(t, map[string][]net.IP{
+		"target.test": {net.ParseIP("127.0.0.1")},
+	})
+	r, err := NewResolver(ResolverConfig{Servers: []string{stub.addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialTarget(ssLog, sessionPolicy{resolver: r}, "tcp", "target.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if stub.count("target.test", "udp") == 0 {
+		t.Error("target is not resolved by the resolver")
+	}
+
+	// the resolved address is checked by the acl
+	acl, err := NewACL(DenyPrivateRules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dialTarget(ssLog, sessionPolicy{acl: acl, resolver: r}, "tcp", "target.test:"+port); err != aclDeniedErr {
+		t.Errorf("expect error %v, but got %v", aclDeniedErr, err)
+	}
+}
@@ -2,9 +2,11 @@ package proxy_server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,24 +14,99 @@ import (
 
 type srv struct {
 	dataAddr string
+	dataTLS  *tls.Config
+	cipher   ssCipher
 	reqs     chan *Request
+	// closed once Loop returns
+	loopDone chan struct{}
 	ctx      context.Context
 	cancel   context.CancelFunc
 
 	tunnelAddr   string
+	tunnelTLS    *tls.Config
 	tunnelConn   net.Conn
+	tunnelCodec  *TLVCodec
+	tunnelOut    *linkWriter
+	tunnelFeat   atomic.Value
 	tunnelErr    chan error
 	tunnelCtx    context.Context
 	tunnelCancel context.CancelFunc
 	tunnelWaiter sync.WaitGroup
 	lastRecvTime atomic.Value
+	pingSent     atomic.Value
+	pings        *pingTracker
+	// vm the ping gauges of the running tunnel are labeled by
+	pingVM string
+
+	// auth of the control tunnel, nil means no handshake
+	auth *tunnelAuth
+
+	// tasks waiting for their results, only touched by Loop
+	tasks map[uint32]*pendingTask
+	// tasks not confirmed by the vm yet, and whether they wait for the
+	// vm of a new tunnel, only touched by Loop
+	journal       *taskJournal
+	replayPending bool
+	// last id given to a task pushed without one, only touched by Loop
+	localTaskSeq uint32
+
+	// reconnect state of the control tunnel, only touched by Loop
+	backoff      *backoff
+	clock        clock
+	reconnect    chan struct{}
+	reconnecting bool
+	reported     bool
+
+	// vms of the control tunnel, the first one is the primary one, only
+	// touched by Loop
+	vms             []VM
+	active          int
+	failback        chan struct{}
+	failbackPending bool
+	probed          chan tunnelProbe
+	probing         bool
+	dialed          chan tunnelProbe
 
 	pluginAddr   string
+	pluginTLS    *tls.Config
 	pluginConn   net.Conn
+	pluginCodec  *TLVCodec
+	pluginOut    *linkWriter
+	pluginFeat   atomic.Value
 	pluginErr    chan error
 	pluginCtx    context.Context
 	pluginCancel context.CancelFunc
 	pluginWaiter sync.WaitGroup
+
+	// records of the ended ss sessions, nil means none
+	sessions SessionSink
+	timeouts SessionTimeouts
+	limiter  *rateLimiter
+	acl      *ACL
+	resolver *Resolver
+
+	// logBase is given by WithLogger, log is the one of component server
+	logBase Logger
+	log     Logger
+	// the loggers of the requests on both links
+	tunnelLogger Logger
+	pluginLogger Logger
+
+	// linkLock serializes the setup and teardown of both links
+	linkLock sync.Mutex
+
+	// the largest value of a message on both links
+	maxMessageSize int
+
+	// outbound queues of both links, outLock guards the writers
+	queueSize   int
+	queuePolicy QueuePolicy
+	outLock     sync.Mutex
+
+	connLock   sync.Mutex
+	closing    bool
+	conns      map[net.Conn]struct{}
+	connWaiter sync.WaitGroup
 }
 
 var (
@@ -41,12 +118,26 @@ var (
 	setupPluginErr   = errors.New("setup plugin failed")
 	setupTunnelErr   = errors.New("setup tunnel failed")
 	pluginExitErr    = errors.New("to be killed")
+	shutdownErr      = errors.New("server is shutting down")
 )
 
-func NewServer(pluginAddr, controlAddr, dataAddr string) (*srv, error) {
-	Debug.Printf("[server]: addresses: plugin[%s], control[%s], data[%s]\n",
-		pluginAddr, controlAddr, dataAddr)
+// ServerOption customizes a server created by NewServer.
+type ServerOption func(*srv) error
+
+// WithCipher sets the shadowsocks cipher method and password used on
+// the data connections of this server.
+func WithCipher(method, password string) ServerOption {
+	return func(s *srv) error {
+		c, err := newSSCipher(method, password)
+		if err != nil {
+			return err
+		}
+		s.cipher = c
+		return nil
+	}
+}
 
+func NewServer(pluginAddr, controlAddr, dataAddr string, opts ...ServerOption) (*srv, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &srv{
@@ -58,11 +149,43 @@ func NewServer(pluginAddr, controlAddr, dataAddr string) (*srv, error) {
 		tunnelErr:  make(chan error, 1),
 		pluginErr:  make(chan error, 1),
 		reqs:       make(chan *Request, 16),
+		loopDone:   make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+		tasks:      make(map[uint32]*pendingTask),
+		journal:    newTaskJournal(defaultJournalSize),
+		pings:      &pingTracker{},
+		backoff:    newBackoff(DefaultReconnectPolicy),
+		clock:      realClock{},
+		limiter:    newRateLimiter(realClock{}),
+		reconnect:  make(chan struct{}),
+		vms:        []VM{{ControlAddr: controlAddr, DataAddr: dataAddr}},
+		failback:   make(chan struct{}),
+		probed:     make(chan tunnelProbe),
+		dialed:     make(chan tunnelProbe),
+
+		maxMessageSize: DefaultMaxMessageSize,
+		queueSize:      defaultQueueSize,
+		queuePolicy:    QueueBlock,
+		logBase:        defaultLogger(),
 	}
 
+	opts = append([]ServerOption{WithCipher(defaultSSMethod, defaultSSPassword)}, opts...)
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			s.logger("server").Error("apply option failed", "err", err)
+			cancel()
+			return nil, err
+		}
+	}
+	s.log = s.logger("server")
+	s.tunnelLogger = s.logger("tunnel")
+	s.pluginLogger = s.logger("plugin")
+	s.journal.log = s.logger("journal")
+	s.log.Debug("addresses", "plugin", pluginAddr, "control", controlAddr, "data", dataAddr)
+
 	err := s.setupPlugin()
 	if err != nil {
-		log.Printf("[server]: setup plugin failed: %s\n", err)
+		s.log.Error("setup plugin failed", "err", err)
 		return nil, setupPluginErr
 	}
 
@@ -75,36 +198,55 @@ func NewServer(pluginAddr, controlAddr, dataAddr string) (*srv, error) {
 func (s *srv) setupPlugin() error {
 	addr := s.pluginAddr
 	if addr == "" {
-		Debug.Println("[server]: plugin address is nil, exit")
+		s.log.Debug("plugin address is nil, exit")
 		return nil
 	}
 
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+	if s.isClosing() {
+		return shutdownErr
+	}
+
 	// terminate old one
 	if s.pluginCancel != nil {
 		s.pluginCancel()
 		s.pluginWaiter.Wait()
+		s.pluginConn.Close()
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	conn, err := dial(addr, s.pluginTLS)
 	if err != nil {
 		return err
 	}
 	ctx, cancel := context.WithCancel(s.ctx)
 	s.pluginConn = conn
+	s.pluginCodec = s.newCodec(conn)
+	s.pluginFeat.Store(LegacyFeatures)
 	s.pluginCtx = ctx
 	s.pluginCancel = cancel
-	s.pluginWaiter.Add(1)
+	out := newLinkWriter(ctx, "plugin", conn, s.pluginCodec, s.queueSize, s.queuePolicy,
+		s.logger("writer"))
+	s.outLock.Lock()
+	s.pluginOut = out
+	s.outLock.Unlock()
+	s.pluginWaiter.Add(2)
 
 	go s.pollPlugin()
+	go func() {
+		out.run(s.pluginErr)
+		s.pluginWaiter.Done()
+	}()
 
+	// the first message of the link
+	s.putPluginRequest(&Request{Typ: PluginFeatures, Features: LocalFeatures})
 	return nil
 }
 
 func (s *srv) pollPlugin() {
 	defer func() {
-		s.pluginConn.Close()
 		s.pluginWaiter.Done()
-		Debug.Println("[server]: plugin poller exits")
+		s.log.Debug("plugin poller exits")
 	}()
 
 	for {
@@ -114,11 +256,18 @@ func (s *srv) pollPlugin() {
 		default:
 			req, err := s.getPluginRequest()
 			if err != nil {
-				s.pluginErr <- err
+				select {
+				case s.pluginErr <- err:
+				case <-s.pluginCtx.Done():
+				}
 				return
 			}
 			if req != nil {
-				s.reqs <- req
+				select {
+				case s.reqs <- req:
+				case <-s.pluginCtx.Done():
+					return
+				}
 			}
 		}
 	}
@@ -127,40 +276,90 @@ func (s *srv) pollPlugin() {
 func (s *srv) setupTunnel() error {
 	addr := s.tunnelAddr
 	if addr == "" {
-		Debug.Println("[server]: tunnel address is nil, exit")
+		s.log.Debug("tunnel address is nil, exit")
 		return nil
 	}
 
-	// terminate old one
-	if s.tunnelCancel != nil {
-		s.tunnelCancel()
-		s.tunnelWaiter.Wait()
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+	if s.isClosing() {
+		return shutdownErr
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	s.stopTunnel()
+	conn, err := s.dialTunnel(addr)
 	if err != nil {
 		return err
 	}
+	s.startTunnel(conn)
+	return nil
+}
+
+// dialTunnel connects and authenticates the control tunnel to addr.
+func (s *srv) dialTunnel(addr string) (net.Conn, error) {
+	conn, err := dial(addr, s.tunnelTLS)
+	if err != nil {
+		return nil, err
+	}
+	if s.auth != nil {
+		if err = s.auth.handshake(s.logger("auth"), conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		s.log.Debug("control link peer authenticated", "peer", conn.RemoteAddr())
+	}
+	return conn, nil
+}
+
+// stopTunnel terminates the current tunnel, the caller holds linkLock.
+func (s *srv) stopTunnel() {
+	if s.tunnelCancel != nil {
+		s.tunnelCancel()
+		s.tunnelWaiter.Wait()
+		s.tunnelConn.Close()
+		s.dropPingMetrics()
+	}
+}
+
+// startTunnel polls the tunnel on conn, the caller holds linkLock.
+func (s *srv) startTunnel(conn net.Conn) {
 	ctx, cancel := context.WithCancel(s.ctx)
 	s.tunnelConn = conn
+	s.tunnelCodec = s.newCodec(conn)
+	s.tunnelFeat.Store(LegacyFeatures)
+	s.pings.reset()
+	s.pingVM = s.tunnelAddr
 	s.tunnelCtx = ctx
 	s.tunnelCancel = cancel
-	s.tunnelWaiter.Add(2)
+	out := newLinkWriter(ctx, "tunnel", conn, s.tunnelCodec, s.queueSize, s.queuePolicy,
+		s.logger("writer"))
+	s.outLock.Lock()
+	s.tunnelOut = out
+	s.outLock.Unlock()
+	s.tunnelWaiter.Add(3)
 
 	go s.pollTunnel()
 	go s.checkTunnel()
+	go func() {
+		out.run(s.tunnelErr)
+		s.tunnelWaiter.Done()
+	}()
 
-	return nil
+	// the first message of the link
+	s.putCtrRequest(&Request{Typ: TunnelFeatures, Features: LocalFeatures})
 }
 
 func (s *srv) pollTunnel() {
 	defer func() {
-		s.tunnelConn.Close()
 		s.tunnelWaiter.Done()
-		Debug.Println("[server]: tunnel poller exits")
+		s.log.Debug("tunnel poller exits")
 	}()
 
-	s.reqs <- &Request{Typ: TunnelConnectOk}
+	select {
+	case s.reqs <- &Request{Typ: TunnelConnectOk}:
+	case <-s.tunnelCtx.Done():
+		return
+	}
 
 	for {
 		select {
@@ -169,14 +368,21 @@ func (s *srv) pollTunnel() {
 		default:
 			req, err := s.getCtrRequest()
 			if err != nil {
-				s.tunnelErr <- err
+				select {
+				case s.tunnelErr <- err:
+				case <-s.tunnelCtx.Done():
+				}
 				return
 			}
 			if req != nil {
 				// update receive timestamp
 				s.lastRecvTime.Store(time.Now())
 
-				s.reqs <- req
+				select {
+				case s.reqs <- req:
+				case <-s.tunnelCtx.Done():
+					return
+				}
 			}
 		}
 	}
@@ -187,29 +393,54 @@ func (s *srv) checkTunnel() {
 	defer func() {
 		t.Stop()
 		s.tunnelWaiter.Done()
-		Debug.Println("[server]: tunnel checker exit")
+		s.log.Debug("tunnel checker exits")
 	}()
 
 	// set current time at first
 	s.lastRecvTime.Store(time.Now())
+	sent := 0
 
 	for {
 		select {
 		case <-s.tunnelCtx.Done():
 			return
 		case cur := <-t.C:
-			// check timeout first
+			// check timeout first, by the lost pings if the vm echoes
+			// them, by the received traffic otherwise
+			stats := loadFeatures(&s.tunnelFeat).Has(CapPingStats)
 			last := s.lastRecvTime.Load().(time.Time)
-			if cur.After(last.Add(checkTimeout)) {
-				s.tunnelErr <- tunnelTimeoutErr
+			if (stats && s.pings.missed(cur) >= missedPingLimit) ||
+				(!stats && cur.After(last.Add(checkTimeout))) {
+				select {
+				case s.tunnelErr <- tunnelTimeoutErr:
+				case <-s.tunnelCtx.Done():
+				}
 				return
 			}
-			s.putCtrRequest(&Request{Typ: Ping})
+
+			now := time.Now()
+			ping := &Request{Typ: Ping, PingSent: now}
+			s.pingSent.Store(now)
+			if stats {
+				ping.PingSeq = s.pings.send(now)
+				sent++
+			}
+			s.putCtrRequest(ping)
+
+			if stats && sent%pingReportEvery == 0 {
+				select {
+				case s.reqs <- &Request{Typ: TunnelPingStats, Stats: s.pings.stats(now)}:
+				case <-s.tunnelCtx.Done():
+					return
+				}
+			}
 		}
 	}
 }
 
 func (s *srv) Loop() error {
+	defer close(s.loopDone)
+
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -218,6 +449,16 @@ func (s *srv) Loop() error {
 			s.handleRequest(req)
 		case err := <-s.tunnelErr:
 			s.handleTunnelErr(err)
+		case <-s.reconnect:
+			s.reconnecting = false
+			s.reconnectTunnel()
+		case <-s.failback:
+			s.failbackPending = false
+			s.failbackTunnel()
+		case p := <-s.probed:
+			s.handleProbe(p)
+		case p := <-s.dialed:
+			s.handleDial(p)
 		case err := <-s.pluginErr:
 			err = s.handlePluginErr(err)
 			if err != nil {
@@ -228,26 +469,145 @@ func (s *srv) Loop() error {
 }
 
 func (s *srv) handleTunnelErr(err error) error {
-	log.Printf("[server]: A error happens on control link: %s\n", err)
+	if s.isClosing() {
+		s.log.Debug("shutting down, ignore control link error", "err", err)
+		return nil
+	}
+	if s.reconnecting {
+		s.log.Debug("reconnect pending, ignore control link error", "err", err)
+		return nil
+	}
+	if err == tunnelAuthErr {
+		s.log.Error("control link peer is not authenticated")
+	} else {
+		s.log.Error("control link failed", "err", err)
+	}
+	if err == tunnelTimeoutErr && len(s.vms) > 1 {
+		s.failover()
+	}
 
-	var reconnectErr error
-	// try to reconnect
-	for i := 0; i < 3; i++ {
-		reconnectErr = s.setupTunnel()
-		if reconnectErr == nil {
-			return nil
+	return s.reconnectTunnel()
+}
+
+// reconnectTunnel tries to setup the tunnel once on each vm, starting
+// from the active one. The vms are dialed in the background, so that
+// blackholed ones don't stall Loop, which picks the result up from
+// s.dialed.
+func (s *srv) reconnectTunnel() error {
+	if s.tunnelAddr == "" {
+		s.log.Debug("tunnel address is nil, exit")
+		return nil
+	}
+	if s.tunnelConn != nil || s.backoff.Attempts() > 0 {
+		tunnelReconnects.add(1)
+	}
+
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+	if s.isClosing() {
+		return shutdownErr
+	}
+	s.stopTunnel()
+	s.reconnecting = true
+	addrs := []string{s.tunnelAddr}
+	for i := 1; i < len(s.vms); i++ {
+		addrs = append(addrs, s.vms[(s.active+i)%len(s.vms)].ControlAddr)
+	}
+	go func(active, n int) {
+		var p tunnelProbe
+		for i, addr := range addrs {
+			p.vm = (active + i) % n
+			p.conn, p.err = s.dialTunnel(addr)
+			if p.err == nil {
+				break
+			}
+			s.logReconnectErr(addr, p.err)
 		}
+		select {
+		case s.dialed <- p:
+		case <-s.ctx.Done():
+			if p.conn != nil {
+				p.conn.Close()
+			}
+		}
+	}(s.active, len(s.vms))
+	return nil
+}
+
+// handleDial starts the tunnel on the vm reconnectTunnel got through
+// to. If all of them failed, the plugin is told once per outage and the
+// next try, from the primary vm, is scheduled by the reconnect policy,
+// Loop picks it up from s.reconnect.
+func (s *srv) handleDial(p tunnelProbe) error {
+	s.reconnecting = false
+	if p.err == nil {
+		s.linkLock.Lock()
+		if s.isClosing() {
+			s.linkLock.Unlock()
+			p.conn.Close()
+			return shutdownErr
+		}
+		if p.vm != s.active {
+			s.useVM(p.vm)
+			s.log.Info("fail over", "vm", s.tunnelAddr)
+		}
+		s.startTunnel(p.conn)
+		s.linkLock.Unlock()
+
+		if s.backoff.Attempts() > 0 {
+			s.log.Debug("tunnel is back", "retries", s.backoff.Attempts())
+		}
+		s.backoff.Reset()
+		s.reported = false
+		s.scheduleFailback()
+		return nil
 	}
 
-	log.Printf("[server]: reconnect failure: %s\n", reconnectErr)
-	go func() {
-		s.reqs <- &Request{Typ: TunnelReconnectFailed}
-	}()
-	return reconnectErr
+	err := p.err
+	if len(s.vms) > 1 {
+		s.useVM(0)
+	}
+	if !s.reported {
+		s.reported = true
+		go func() {
+			select {
+			case s.reqs <- &Request{Typ: TunnelReconnectFailed}:
+			case <-s.ctx.Done():
+			}
+		}()
+	}
+
+	d, ok := s.backoff.Next()
+	if !ok {
+		s.log.Error("give up reconnecting", "retries", s.backoff.Attempts())
+		return err
+	}
+	s.log.Debug("reconnect later", "retry", s.backoff.Attempts(), "delay", d)
+	s.reconnecting = true
+	go func(c <-chan time.Time) {
+		select {
+		case <-c:
+		case <-s.ctx.Done():
+			return
+		}
+		select {
+		case s.reconnect <- struct{}{}:
+		case <-s.ctx.Done():
+		}
+	}(s.clock.After(d))
+	return err
+}
+
+func (s *srv) logReconnectErr(addr string, err error) {
+	if err == tunnelAuthErr {
+		s.log.Error("reconnect failed, peer is not authenticated", "vm", addr)
+	} else {
+		s.log.Error("reconnect failed", "vm", addr, "err", err)
+	}
 }
 
 func (s *srv) handlePluginErr(err error) error {
-	log.Printf("[server]: A error happens on plugin link: %s\n", err)
+	s.log.Error("plugin link failed", "err", err)
 	return err
 }
 
@@ -262,75 +622,319 @@ const (
 	Ping
 	TunnelConnectOk
 	Exit
+	CreateSSUDPConnect
+	ServerShutdown
+	TunnelFeatures
+	PluginFeatures
+	TaskTimeout
+	TaskAck
+	TunnelPingStats
+	SessionEnd
 
 	TypeEnd
 )
 
+var requestTypeNames = [...]string{
+	CreateSSConnect:       "CreateSSConnect",
+	PushTaskRecv:          "PushTaskRecv",
+	PushTask:              "PushTask",
+	TaskResult:            "TaskResult",
+	TunnelReconnectFailed: "TunnelReconnectFailed",
+	Ping:                  "Ping",
+	TunnelConnectOk:       "TunnelConnectOk",
+	Exit:                  "Exit",
+	CreateSSUDPConnect:    "CreateSSUDPConnect",
+	ServerShutdown:        "ServerShutdown",
+	TunnelFeatures:        "TunnelFeatures",
+	PluginFeatures:        "PluginFeatures",
+	TaskTimeout:           "TaskTimeout",
+	TaskAck:               "TaskAck",
+	TunnelPingStats:       "TunnelPingStats",
+	SessionEnd:            "SessionEnd",
+}
+
+func (t RequestType) String() string {
+	if t >= 0 && t < TypeEnd {
+		return requestTypeNames[t]
+	}
+	return "RequestType(" + strconv.Itoa(int(t)) + ")"
+}
+
 type Request struct {
 	Typ       RequestType
 	SocketKey string
 	TaskData  []byte
+	Features  Features
+	// TaskID is the id of a task message, 0 means no id, the task
+	// times out after Timeout if it is not 0.
+	TaskID  uint32
+	Timeout time.Duration
+	// PingSeq is the sequence number of a ping sent at PingSent, 0
+	// means a legacy ping without payload.
+	PingSeq  uint32
+	PingSent time.Time
+	Stats    PingStats
+	// Session is the record of an ended ss session.
+	Session SessionRecord
 }
 
 func (s *srv) handleRequest(req *Request) error {
-	Debug.Printf("[server]: handle request [%#v]\n", req)
+	if s.log.Enabled(LevelDebug) {
+		s.log.Debug("handle request", "request", req.Typ, "req", fmt.Sprintf("%+v", req))
+	}
+	defer s.tunnelReady(req)
+
 	switch req.Typ {
 	case CreateSSConnect:
-		go HandleSSConnectRequest(s.dataAddr, req.SocketKey)
-	case PushTaskRecv:
-		go s.putCtrRequest(req)
-	case PushTask:
-		go s.putCtrRequest(req)
+		go s.HandleSSConnectRequest(s.dataAddr, req.SocketKey)
+	case CreateSSUDPConnect:
+		go s.HandleSSUDPConnectRequest(s.dataAddr, req.SocketKey)
+	case PushTaskRecv, PushTask:
+		if req.TaskID == 0 {
+			req.TaskID = s.localTaskID()
+		}
+		if !s.journal.add(req) {
+			s.log.Info("task is pushed already, suppress it", "task", req.TaskID)
+			break
+		}
+		// the result can't be matched if the vm drops the id
+		if req.Timeout > 0 && loadFeatures(&s.tunnelFeat).Has(CapTaskID) {
+			s.trackTask(req)
+		}
+		s.sendTask(req)
+	case TaskAck:
+		if !s.journal.confirm(req.TaskID) {
+			s.log.Debug("ack of task is not expected", "task", req.TaskID)
+		}
 	case TaskResult:
-		go s.putPluginRequest(req)
+		if req.TaskID != 0 {
+			if !s.journal.finish(req.TaskID) {
+				s.log.Info("duplicated or late task result, suppress it", "task", req.TaskID)
+				break
+			}
+			if !s.finishTask(req.TaskID) {
+				s.log.Debug("task result is not pending", "task", req.TaskID)
+			}
+		}
+		if req.TaskID&localTaskBit != 0 {
+			// the plugin pushed it without an id
+			req.TaskID = 0
+		}
+		s.putPluginRequest(req)
+	case TaskTimeout:
+		if s.finishTask(req.TaskID) {
+			// the plugin is done with it, a late result is dropped
+			s.journal.finish(req.TaskID)
+			s.log.Info("task timed out", "task", req.TaskID)
+			s.putPluginRequest(req)
+		}
 	case TunnelReconnectFailed:
-		go s.putPluginRequest(req)
+		s.putPluginRequest(req)
 	case Ping:
-		// ping ack, do nothing
-		Debug.Println("[server]: recv ping ack")
+		s.log.Debug("recv ping ack")
+		s.handlePingAck(req)
+	case TunnelPingStats, SessionEnd:
+		s.putPluginRequest(req)
 	case TunnelConnectOk:
-		go s.putPluginRequest(req)
+		s.putPluginRequest(req)
+		s.replayPending = true
+	case ServerShutdown:
+		s.putPluginRequest(req)
+	case TunnelFeatures:
+		f := LocalFeatures.Negotiate(req.Features)
+		s.log.Debug("control link features", "version", f.Version, "caps", f.Caps)
+		s.tunnelFeat.Store(f)
+	case PluginFeatures:
+		f := LocalFeatures.Negotiate(req.Features)
+		s.log.Debug("plugin link features", "version", f.Version, "caps", f.Caps)
+		s.pluginFeat.Store(f)
 	case Exit:
 		go func() {
 			s.pluginErr <- pluginExitErr
 		}()
 	default:
-		log.Printf("[server]: unknown request type[%x]\n", req.Typ)
+		s.log.Error("unknown request type", "request", req.Typ)
 		return unknownTypeErr
 	}
 	return nil
 }
 
+// Shutdown stops the server gracefully: it stops polling both links,
+// reports the shutdown to the plugin and waits for the active data
+// connections to finish. Those still running when ctx is done are
+// closed and ctx.Err() is returned. Both links are closed at last and
+// Loop returns nil.
+func (s *srv) Shutdown(ctx context.Context) error {
+	s.connLock.Lock()
+	if s.closing {
+		s.connLock.Unlock()
+		return shutdownErr
+	}
+	s.closing = true
+	s.connLock.Unlock()
+	s.log.Debug("shutdown start")
+
+	// stop polling
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+	if s.tunnelCancel != nil {
+		s.tunnelCancel()
+		s.tunnelWaiter.Wait()
+	}
+	if s.pluginCancel != nil {
+		s.pluginCancel()
+		s.pluginWaiter.Wait()
+	}
+
+	// the plugin writer is stopped, write it directly,
+	// the deadline left by the writer may have expired already
+	var err error
+	if s.pluginConn != nil {
+		var tlv TLV
+		tlv, err = encodePluginRequest(s.pluginLogger, &Request{Typ: ServerShutdown},
+			loadFeatures(&s.pluginFeat))
+		if err == nil {
+			deadline := time.Now().Add(writeTimeout)
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			err = s.pluginConn.SetWriteDeadline(deadline)
+		}
+		if err == nil {
+			err = s.pluginCodec.WriteTLV(tlv)
+		}
+	}
+	if err != nil {
+		s.log.Error("report shutdown to plugin failed", "err", err)
+	}
+
+	// drain data connections
+	drained := make(chan struct{})
+	go func() {
+		s.connWaiter.Wait()
+		close(drained)
+	}()
+	err = nil
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.connLock.Lock()
+		s.log.Error("shutdown: close active data connections", "count", len(s.conns), "err", err)
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connLock.Unlock()
+		<-drained
+	}
+
+	if s.tunnelConn != nil {
+		s.tunnelConn.Close()
+	}
+	if s.pluginConn != nil {
+		s.pluginConn.Close()
+	}
+	s.cancel()
+	s.log.Debug("shutdown done")
+
+	return err
+}
+
+func (s *srv) isClosing() bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return s.closing
+}
+
+// addConn tracks an active data connection, it fails once the server
+// is shutting down.
+func (s *srv) addConn(conn net.Conn) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.connWaiter.Add(1)
+	activeConns.add(1)
+	return true
+}
+
+func (s *srv) removeConn(conn net.Conn) {
+	s.connLock.Lock()
+	delete(s.conns, conn)
+	s.connLock.Unlock()
+	s.connWaiter.Done()
+	activeConns.add(-1)
+}
+
 // helpers
+func (s *srv) logger(component string) Logger {
+	return s.logBase.With("component", component)
+}
+
 func (s *srv) putCtrRequest(req *Request) error {
-	if s.tunnelConn == nil {
-		Debug.Printf("[server]: tunnel connection is nil, skip this request[%#v]\n", req)
+	out := s.writer(&s.tunnelOut)
+	if out == nil {
+		s.log.Debug("tunnel is not setup, skip request", "request", req.Typ)
 		return nil
 	}
-	return PutCtrRequest(s.tunnelConn, req)
+	tlv, err := encodeCtrRequest(s.tunnelLogger, req, loadFeatures(&s.tunnelFeat))
+	if err != nil {
+		return err
+	}
+	return out.put(tlv)
 }
 
 func (s *srv) putPluginRequest(req *Request) error {
-	if s.pluginConn == nil {
-		Debug.Printf("[server]: plugin connection is nil, skip this request[%#v]\n", req)
+	out := s.writer(&s.pluginOut)
+	if out == nil {
+		s.log.Debug("plugin is not setup, skip request", "request", req.Typ)
 		return nil
 	}
-	return PutPluginRequest(s.pluginConn, req)
+	tlv, err := encodePluginRequest(s.pluginLogger, req, loadFeatures(&s.pluginFeat))
+	if err != nil {
+		return err
+	}
+	return out.put(tlv)
+}
+
+// writer returns the writer of a link, nil if it is not setup.
+func (s *srv) writer(out **linkWriter) *linkWriter {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	return *out
+}
+
+// newCodec returns the codec of a link on conn.
+func (s *srv) newCodec(conn net.Conn) *TLVCodec {
+	c := NewTLVCodec(conn)
+	c.SetMaxMessageSize(s.maxMessageSize)
+	c.SetLogger(s.logger("tlv"))
+	return c
+}
+
+// loadFeatures returns the features negotiated on a link, a link which
+// is not setup speaks the legacy ones.
+func loadFeatures(v *atomic.Value) Features {
+	f, _ := v.Load().(Features)
+	return f
 }
 
 func (s *srv) getPluginRequest() (*Request, error) {
 	if s.pluginConn == nil {
-		Debug.Printf("[server]: plugin connection is nil, skip request get")
+		s.log.Debug("plugin connection is nil, skip request get")
 		return nil, nil
 	}
 	err := s.pluginConn.SetReadDeadline(time.Now().Add(pollTimeout))
 	if err != nil {
-		log.Printf("[server]: set plugin read deadline error: %v\n", err)
+		s.log.Error("set plugin read deadline failed", "err", err)
 	}
-	r, err := GetPluginRequest(s.pluginConn)
+	r, err := getPluginRequest(s.pluginLogger, s.pluginCodec)
 	if err != nil {
 		ne, ok := err.(net.Error)
-		if ok && ne.Temporary() {
+		// the codec skips a too large message
+		if (ok && ne.Temporary()) || err == tooLargeErr {
 			return nil, nil
 		}
 	}
@@ -339,17 +943,18 @@ func (s *srv) getPluginRequest() (*Request, error) {
 
 func (s *srv) getCtrRequest() (*Request, error) {
 	if s.tunnelConn == nil {
-		Debug.Printf("[server]: tunnel connection is nil, skip request get")
+		s.log.Debug("tunnel connection is nil, skip request get")
 		return nil, nil
 	}
 	err := s.tunnelConn.SetReadDeadline(time.Now().Add(pollTimeout))
 	if err != nil {
-		log.Printf("[server]: set tunnel read deadline error: %v\n", err)
+		s.log.Error("set tunnel read deadline failed", "err", err)
 	}
-	r, err := GetCtrRequest(s.tunnelConn)
+	r, err := getCtrRequest(s.tunnelLogger, s.tunnelCodec)
 	if err != nil {
 		ne, ok := err.(net.Error)
-		if ok && ne.Temporary() {
+		// the codec skips a too large message
+		if (ok && ne.Temporary()) || err == tooLargeErr {
 			return nil, nil
 		}
 	}
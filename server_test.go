@@ -3,6 +3,7 @@ package proxy_server
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http/httptest"
 	"reflect"
@@ -10,6 +11,46 @@ import (
 	"time"
 )
 
+// setPollTimeout sets pollTimeout until t ends.
+func setPollTimeout(t *testing.T, d time.Duration) {
+	old := pollTimeout
+	pollTimeout = d
+	t.Cleanup(func() { pollTimeout = old })
+}
+
+// setWriteTimeout sets writeTimeout until t ends.
+func setWriteTimeout(t *testing.T, d time.Duration) {
+	old := writeTimeout
+	writeTimeout = d
+	t.Cleanup(func() { writeTimeout = old })
+}
+
+// setTunnelConn makes conn the control link of s as startTunnel does,
+// without polling it.
+func setTunnelConn(s *srv, conn net.Conn) {
+	s.tunnelConn = conn
+	s.tunnelCodec = s.newCodec(conn)
+	out := newLinkWriter(s.ctx, "tunnel", conn, s.tunnelCodec, s.queueSize, s.queuePolicy,
+		s.logger("writer"))
+	s.outLock.Lock()
+	s.tunnelOut = out
+	s.outLock.Unlock()
+	go out.run(s.tunnelErr)
+}
+
+// setPluginConn makes conn the plugin link of s as setupPlugin does,
+// without polling it.
+func setPluginConn(s *srv, conn net.Conn) {
+	s.pluginConn = conn
+	s.pluginCodec = s.newCodec(conn)
+	out := newLinkWriter(s.ctx, "plugin", conn, s.pluginCodec, s.queueSize, s.queuePolicy,
+		s.logger("writer"))
+	s.outLock.Lock()
+	s.pluginOut = out
+	s.outLock.Unlock()
+	go out.run(s.pluginErr)
+}
+
 func TestNewServer(t *testing.T) {
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -59,6 +100,32 @@ func TestNewServer(t *testing.T) {
 	}
 }
 
+func TestNewServerCipher(t *testing.T) {
+	s1, err := NewServer("", "", "", WithCipher("aes-256-cfb", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.cancel()
+	s2, err := NewServer("", "", "", WithCipher("", "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.cancel()
+	if s1.cipher == s2.cipher {
+		t.Error("servers should not share the same cipher")
+	}
+
+	for name, opt := range map[string]ServerOption{
+		"badMethod":     WithCipher("foo", "bar"),
+		"emptyPassword": WithCipher("aes-256-cfb", ""),
+	} {
+		if s, err := NewServer("", "", "", opt); err == nil {
+			s.cancel()
+			t.Errorf("%s: not get expected error", name)
+		}
+	}
+}
+
 func TestPollPlugin(t *testing.T) {
 	s, err := NewServer("", "", "")
 	if err != nil {
@@ -69,12 +136,12 @@ func TestPollPlugin(t *testing.T) {
 	s.pluginCtx, s.pluginCancel = context.WithCancel(s.ctx)
 
 	r, w := net.Pipe()
-	s.pluginConn = r
+	setPluginConn(s, r)
 	ret := make(chan struct{})
 	defer close(ret)
 
+	s.pluginWaiter.Add(1)
 	go func() {
-		s.pluginWaiter.Add(1)
 		s.pollPlugin()
 		ret <- struct{}{}
 	}()
@@ -92,6 +159,20 @@ func TestPollPlugin(t *testing.T) {
 		t.Fatalf("expect request %#v, but got %#v", expect, got)
 	}
 
+	// a too large message is skipped, the link is kept
+	s.pluginCodec.SetMaxMessageSize(4)
+	err = WriteTLV(w, TLV{T: pPushTask, L: 5, V: []byte{1, 2, 3, 4, 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteTLV(w, TLV{T: pPushTask, L: 1, V: []byte{2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-s.reqs; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect request %#v, but got %#v", expect, got)
+	}
+
 	// mock a failure
 	err = WriteTLV(w, TLV{T: 0xff, L: 1, V: []byte{2}})
 	if err != nil {
@@ -101,8 +182,8 @@ func TestPollPlugin(t *testing.T) {
 	<-ret
 
 	// mock done
+	s.pluginWaiter.Add(1)
 	go func() {
-		s.pluginWaiter.Add(1)
 		s.pollPlugin()
 		ret <- struct{}{}
 	}()
@@ -120,12 +201,12 @@ func TestPollTunnel(t *testing.T) {
 	s.tunnelCtx, s.tunnelCancel = context.WithCancel(s.ctx)
 
 	r, w := net.Pipe()
-	s.tunnelConn = r
+	setTunnelConn(s, r)
 	ret := make(chan struct{})
 	defer close(ret)
 
+	s.tunnelWaiter.Add(1)
 	go func() {
-		s.tunnelWaiter.Add(1)
 		s.pollTunnel()
 		ret <- struct{}{}
 	}()
@@ -161,8 +242,8 @@ func TestPollTunnel(t *testing.T) {
 	<-ret
 
 	// mock done
+	s.tunnelWaiter.Add(1)
 	go func() {
-		s.tunnelWaiter.Add(1)
 		s.pollTunnel()
 		ret <- struct{}{}
 	}()
@@ -179,18 +260,22 @@ func TestCheckTunnel(t *testing.T) {
 	defer s.cancel()
 
 	r, w := net.Pipe()
-	s.tunnelConn = r
+	setTunnelConn(s, r)
 	ret := make(chan struct{})
 	defer close(ret)
 
 	s.tunnelCtx, s.tunnelCancel = context.WithCancel(s.ctx)
 	const expectCount = 5
 	expectReq := &Request{Typ: Ping}
+	interval, timeout := checkInterval, checkTimeout
+	t.Cleanup(func() { checkInterval, checkTimeout = interval, timeout })
 	checkInterval = 1 * time.Millisecond
-	checkTimeout = (expectCount + 1) * checkInterval
+	// pings are queued without waiting for the reader, leave room for
+	// the scheduler before the timeout
+	checkTimeout = 10 * (expectCount + 1) * checkInterval
 
+	s.tunnelWaiter.Add(1)
 	go func() {
-		s.tunnelWaiter.Add(1)
 		s.checkTunnel()
 		ret <- struct{}{}
 	}()
@@ -212,8 +297,8 @@ func TestCheckTunnel(t *testing.T) {
 	<-ret
 
 	// mock done
+	s.tunnelWaiter.Add(1)
 	go func() {
-		s.tunnelWaiter.Add(1)
 		s.checkTunnel()
 		ret <- struct{}{}
 	}()
@@ -235,15 +320,14 @@ func TestHandleTunnelErr(t *testing.T) {
 		t.Fatalf("got unexpected error: %v", err)
 	}
 
-	go s.Loop()
-	// mock a failed reconnection
+	// mock a failed reconnection, Loop owns the reconnect state from
+	// now on
+	<-s.tunnelErr
 	r, w := net.Pipe()
-	s.pluginConn = w
+	setPluginConn(s, w)
 	s.tunnelAddr = "127.0.0.1:1"
-	err = s.handleTunnelErr(tunnelTimeoutErr)
-	if err == nil {
-		t.Fatal("not get expected error")
-	}
+	go s.Loop()
+	s.tunnelErr <- tunnelTimeoutErr
 	expect := TLV{T: pTunnelReconnectFailed, L: 0, V: []byte{}}
 	got, err := ReadTLV(r)
 	if err != nil {
@@ -262,7 +346,7 @@ func TestSetupTunnelFailureFirstTime(t *testing.T) {
 	defer s.cancel()
 
 	r, w := net.Pipe()
-	s.pluginConn = w
+	setPluginConn(s, w)
 
 	// mock a failed setup
 	s.tunnelAddr = "127.0.0.1:1"
@@ -285,8 +369,8 @@ func TestHandleRequest(t *testing.T) {
 	}
 	defer s.cancel()
 	conn, _ := net.Pipe()
-	s.pluginConn = conn
-	s.tunnelConn = conn
+	setPluginConn(s, conn)
+	setTunnelConn(s, conn)
 
 	for i := CreateSSConnect; i < TypeEnd; i++ {
 		i := i
@@ -317,10 +401,10 @@ func TestGetRequestTimeout(t *testing.T) {
 	}
 	defer s.cancel()
 
-	s.pluginConn = conn
-	s.tunnelConn = conn
+	setPluginConn(s, conn)
+	setTunnelConn(s, conn)
 
-	pollTimeout = 1 * time.Millisecond
+	setPollTimeout(t, time.Millisecond)
 	for name, f := range map[string]func(*testing.T){
 		"ctr": func(t *testing.T) {
 			_, err := s.getCtrRequest()
@@ -340,21 +424,25 @@ func TestGetRequestTimeout(t *testing.T) {
 }
 
 func TestReSetup(t *testing.T) {
-	Debug = true
 	ts := httptest.NewServer(nil)
 	defer ts.Close()
 
 	addr := ts.Listener.Addr().String()
-	s, err := NewServer("", "", "")
+	s, err := NewServer("", "", "", WithLogger(NewLogger(io.Discard, LevelDebug, TextFormat)))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer s.cancel()
+	// the pollers read pollTimeout until they exit
+	defer func() {
+		s.cancel()
+		s.tunnelWaiter.Wait()
+		s.pluginWaiter.Wait()
+	}()
 
 	s.tunnelAddr = addr
 	s.pluginAddr = addr
 
-	pollTimeout = 1 * time.Millisecond
+	setPollTimeout(t, time.Millisecond)
 	for name, f := range map[string]func(*testing.T){
 		"tunnel": func(t *testing.T) {
 			err := s.setupTunnel()
@@ -382,3 +470,119 @@ func TestReSetup(t *testing.T) {
 		t.Run(name, f)
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	for name, c := range map[string]struct {
+		timeout time.Duration
+		drain   bool
+		idle    time.Duration
+		err     error
+	}{
+		"drained": {
+			timeout: time.Second,
+			drain:   true,
+		},
+		"idle": {
+			timeout: time.Second,
+			drain:   true,
+			idle:    300 * time.Millisecond,
+		},
+		"timeout": {
+			timeout: 10 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			plugin := make(chan net.Conn, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Log(err)
+					return
+				}
+				plugin <- conn
+			}()
+
+			setPollTimeout(t, time.Millisecond)
+			if c.idle > 0 {
+				setWriteTimeout(t, c.idle/3)
+			}
+			s, err := NewServer(l.Addr().String(), "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := <-plugin
+			defer p.Close()
+			loopRet := make(chan error)
+			go func() {
+				loopRet <- s.Loop()
+			}()
+
+			// the plugin announces it understands the shutdown, once
+			// the server does
+			expectAnnounce(t, p, pFeaturesAck)
+			v := LocalFeatures.marshal()
+			err = WriteTLV(p, TLV{T: pFeatures, L: uint32(len(v)), V: v})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for !loadFeatures(&s.pluginFeat).Has(CapServerShutdown) {
+				time.Sleep(time.Millisecond)
+			}
+
+			// mock an active data connection
+			c1, c2 := net.Pipe()
+			if !s.addConn(c1) {
+				t.Fatal("add connection failed")
+			}
+			connDone := make(chan struct{})
+			go func() {
+				c1.Read(make([]byte, 1))
+				s.removeConn(c1)
+				close(connDone)
+			}()
+			if c.drain {
+				c2.Close()
+				<-connDone
+			}
+			// the write deadline left by the last ack expires
+			time.Sleep(c.idle)
+
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			defer cancel()
+			if err = s.Shutdown(ctx); err != c.err {
+				t.Errorf("expect error %v, but got %v", c.err, err)
+			}
+			<-connDone
+
+			expect := TLV{T: pServerShutdown, L: 0, V: []byte{}}
+			got, err := ReadTLV(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, expect) {
+				t.Fatalf("expect %#v, but got %#v", expect, got)
+			}
+			// plugin link is closed
+			if _, err = ReadTLV(p); err == nil {
+				t.Error("plugin link should be closed")
+			}
+
+			if err = <-loopRet; err != nil {
+				t.Errorf("expect loop returns nil, but got %v", err)
+			}
+			if s.addConn(c2) {
+				t.Error("should not accept connection after shutdown")
+			}
+			if err = s.Shutdown(context.Background()); err != shutdownErr {
+				t.Errorf("expect error %v, but got %v", shutdownErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package proxy_server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CloseReason is what ends a session, the first of its pipes to stop
+// decides it.
+type CloseReason int
+
+const (
+	// CloseEOF: a side closed its connection.
+	CloseEOF CloseReason = iota
+	CloseReadError
+	CloseWriteError
+	// CloseTimeout: a read timed out.
+	CloseTimeout
+	// CloseIdle: no byte is relayed either way for the idle timeout.
+	CloseIdle
+	// CloseLifetime: the session is older than its lifetime.
+	CloseLifetime
+	// CloseBadRequest: the request names a target but is not valid,
+	// e.g. its one time auth doesn't match.
+	CloseBadRequest
+	// CloseDenied: the acl denies the target.
+	CloseDenied
+	// CloseDialError: the target can't be connected.
+	CloseDialError
+)
+
+var closeReasonNames = [...]string{
+	CloseEOF:        "eof",
+	CloseReadError:  "read error",
+	CloseWriteError: "write error",
+	CloseTimeout:    "read timeout",
+	CloseIdle:       "idle timeout",
+	CloseLifetime:   "lifetime",
+	CloseBadRequest: "bad request",
+	CloseDenied:     "denied",
+	CloseDialError:  "dial error",
+}
+
+func (r CloseReason) String() string {
+	if r >= 0 && int(r) < len(closeReasonNames) {
+		return closeReasonNames[r]
+	}
+	return "CloseReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// timeout reports whether r is a timeout of the session.
+func (r CloseReason) timeout() bool {
+	return r == CloseTimeout || r == CloseIdle || r == CloseLifetime
+}
+
+func (r CloseReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// closeReason returns the reason of a pipe ended by err, which is
+// returned by a write if write is true.
+func closeReason(err error, write bool) CloseReason {
+	if err == nil || err == io.EOF {
+		return CloseEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseTimeout
+	}
+	if write {
+		return CloseWriteError
+	}
+	return CloseReadError
+}
+
+// SessionRecord is the summary of an ended ss session.
+type SessionRecord struct {
+	Key    string    `json:"key"`
+	Target string    `json:"target"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// BytesUp are sent from the client to the target, BytesDown back
+	BytesUp   int64       `json:"bytes_up"`
+	BytesDown int64       `json:"bytes_down"`
+	Reason    CloseReason `json:"reason"`
+	// Err is the error ending the session, empty at eof
+	Err string `json:"err,omitempty"`
+}
+
+// The plugin speaking CapSessionRecord is told each ended session:
+//
+//	pSessionRecord V = start(8) | end(8) | up(8) | down(8) | reason(1) |
+//		key length(2) | key | target length(2) | target
+//
+// the times in unix nanoseconds.
+const lenSessionRecordBase = 8 + 8 + 8 + 8 + 1 + 2 + 2
+
+func (r SessionRecord) marshal() []byte {
+	v := make([]byte, 0, lenSessionRecordBase+len(r.Key)+len(r.Target))
+	v = binary.BigEndian.AppendUint64(v, uint64(r.Start.UnixNano()))
+	v = binary.BigEndian.AppendUint64(v, uint64(r.End.UnixNano()))
+	v = binary.BigEndian.AppendUint64(v, uint64(r.BytesUp))
+	v = binary.BigEndian.AppendUint64(v, uint64(r.BytesDown))
+	v = append(v, byte(r.Reason))
+	v = binary.BigEndian.AppendUint16(v, uint16(len(r.Key)))
+	v = append(v, r.Key...)
+	v = binary.BigEndian.AppendUint16(v, uint16(len(r.Target)))
+	return append(v, r.Target...)
+}
+
+// sessionPolicy is what bounds a ss session.
+type sessionPolicy struct {
+	// targets allowed, nil means any
+	acl *ACL
+	// resolver of the targets, nil means the system one
+	resolver *Resolver
+	timeouts SessionTimeouts
+	// shapers of the traffic from the client (up) and back
+	up, down shaper
+}
+
+// SessionSink receives the records of the ended sessions, it is called
+// concurrently by them.
+type SessionSink interface {
+	Record(r SessionRecord)
+}
+
+// SessionSinkFunc is a SessionSink calling itself.
+type SessionSinkFunc func(r SessionRecord)
+
+func (f SessionSinkFunc) Record(r SessionRecord) {
+	f(r)
+}
+
+type jsonSessionSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewJSONSessionSink returns a sink writing a json record per line to
+// w.
+func NewJSONSessionSink(w io.Writer) SessionSink {
+	return &jsonSessionSink{w: w}
+}
+
+func (j *jsonSessionSink) Record(r SessionRecord) {
+	d, err := json.Marshal(r)
+	if err != nil {
+		sessionLog.Error("marshal session record failed", "key", r.Key, "err", err)
+		return
+	}
+	j.lock.Lock()
+	_, err = j.w.Write(append(d, '\n'))
+	j.lock.Unlock()
+	if err != nil {
+		sessionLog.Error("write session record failed", "key", r.Key, "err", err)
+	}
+}
+
+// WithSessionSink makes the server give the records of its sessions to
+// sink.
+func WithSessionSink(sink SessionSink) ServerOption {
+	return func(s *srv) error {
+		s.sessions = sink
+		return nil
+	}
+}
+
+// recordSession gives rec to the sink and to the plugin if it speaks
+// CapSessionRecord.
+func (s *srv) recordSession(rec SessionRecord) {
+	if s.sessions != nil {
+		s.sessions.Record(rec)
+	}
+	if !loadFeatures(&s.pluginFeat).Has(CapSessionRecord) {
+		return
+	}
+	select {
+	case s.reqs <- &Request{Typ: SessionEnd, Session: rec}:
+	case <-s.loopDone:
+		s.log.Debug("loop exited, drop session record", "key", rec.Key)
+	case <-s.ctx.Done():
+	}
+}
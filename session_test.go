@@ -0,0 +1,94 @@
+package proxy_server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCloseReason(t *testing.T) {
+	for name, c := range map[string]struct {
+		err    error
+		write  bool
+		expect CloseReason
+	}{
+		"eof":          {err: io.EOF, expect: CloseEOF},
+		"none":         {expect: CloseEOF},
+		"read":         {err: errors.New("reset"), expect: CloseReadError},
+		"write":        {err: errors.New("reset"), write: true, expect: CloseWriteError},
+		"timeout":      {err: os.ErrDeadlineExceeded, expect: CloseTimeout},
+		"writeTimeout": {err: os.ErrDeadlineExceeded, write: true, expect: CloseTimeout},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := closeReason(c.err, c.write); got != c.expect {
+				t.Errorf("expect %v, but got %v", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestJSONSessionSink(t *testing.T) {
+	var b bytes.Buffer
+	sink := NewJSONSessionSink(&b)
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		sink.Record(SessionRecord{
+			Key:       "k",
+			Target:    "a:1",
+			Start:     start,
+			End:       start.Add(time.Second),
+			BytesUp:   int64(i),
+			BytesDown: 2,
+			Reason:    CloseReadError,
+			Err:       "reset",
+		})
+	}
+
+	var expect string
+	for i := 0; i < 2; i++ {
+		expect += `{"key":"k","target":"a:1","start":"2020-01-02T03:04:05Z","end":"2020-01-02T03:04:06Z",` +
+			`"bytes_up":` + strconv.Itoa(i) + `,"bytes_down":2,"reason":"read error","err":"reset"}` + "\n"
+	}
+	if got := b.String(); got != expect {
+		t.Errorf("expect %q, but got %q", expect, got)
+	}
+}
+
+func TestRecordSessionLoopExited(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+	s.pluginFeat.Store(LocalFeatures)
+
+	loopRet := make(chan error)
+	go func() {
+		loopRet <- s.Loop()
+	}()
+	s.pluginErr <- io.EOF
+	if err = <-loopRet; err != io.EOF {
+		t.Fatalf("expect error %v, but got %v", io.EOF, err)
+	}
+
+	// more records than the requests queued are dropped
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i <= cap(s.reqs); i++ {
+			s.recordSession(SessionRecord{Key: "k"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("record blocks once loop exits")
+	}
+}
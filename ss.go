@@ -2,28 +2,60 @@ package proxy_server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"strconv"
+	"sync/atomic"
+	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
 
-var (
-	cipher *ss.Cipher
+const (
+	defaultSSMethod   = "aes-128-cfb"
+	defaultSSPassword = "123"
 )
 
-func init() {
-	var err error
-	cipher, err = ss.NewCipher("aes-128-cfb", "123")
+// ssCipher wraps a data connection into an encrypted session.
+type ssCipher interface {
+	newConn(conn net.Conn) net.Conn
+}
+
+// otaConn is a session supporting one time auth, only the stream
+// ciphers of shadowsocks-go have it.
+type otaConn interface {
+	net.Conn
+	GetIv() []byte
+	GetKey() []byte
+	GetAndIncrChunkId() uint32
+}
+
+type streamCipher struct {
+	*ss.Cipher
+}
+
+func (c streamCipher) newConn(conn net.Conn) net.Conn {
+	return ss.NewConn(conn, c.Copy())
+}
+
+// newSSCipher validates method and password and returns the cipher used
+// for data connections, an empty method means the default one.
+func newSSCipher(method, password string) (ssCipher, error) {
+	if method == "" {
+		method = defaultSSMethod
+	}
+	if _, ok := aeadMethods[method]; ok {
+		return newAEADCipher(method, password)
+	}
+	c, err := ss.NewCipher(method, password)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return streamCipher{c}, nil
 }
 
 const (
@@ -42,7 +74,7 @@ const (
 	lenHmacSha1 = 10
 )
 
-func getSSRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
+func getSSRequest(conn net.Conn, auth bool) (host string, ota bool, err error) {
 	// buf size should at least have the same size with the largest possible
 	// request size (when addrType is 3, domain name has at most 256 bytes)
 	// 1(addrType) + 1(lenByte) + 256(max length address) + 2(port) + 10(hmac-sha1)
@@ -51,50 +83,38 @@ func getSSRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	if _, err = io.ReadFull(conn, buf[:idType+1]); err != nil {
 		return
 	}
-
-	var reqStart, reqEnd int
 	addrType := buf[idType]
-	switch addrType & ss.AddrMask {
-	case typeIPv4:
-		reqStart, reqEnd = idIP0, idIP0+lenIPv4
-	case typeIPv6:
-		reqStart, reqEnd = idIP0, idIP0+lenIPv6
-	case typeDm:
+	reqStart := idIP0
+	if addrType&ss.AddrMask == typeDm {
 		if _, err = io.ReadFull(conn, buf[idType+1:idDmLen+1]); err != nil {
 			return
 		}
-		reqStart, reqEnd = idDm0, int(idDm0+buf[idDmLen]+lenDmBase)
-	default:
-		err = fmt.Errorf("addr type %d not supported", addrType&ss.AddrMask)
-		return
+		reqStart = idDm0
 	}
 
+	reqEnd, err := ssAddrLen(buf)
+	if err != nil {
+		return
+	}
 	if _, err = io.ReadFull(conn, buf[reqStart:reqEnd]); err != nil {
 		return
 	}
-
-	// Return string for typeIP is not most efficient, but browsers (Chrome,
-	// Safari, Firefox) all seems using typeDm exclusively. So this is not a
-	// big problem.
-	switch addrType & ss.AddrMask {
-	case typeIPv4:
-		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
-	case typeIPv6:
-		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
-	case typeDm:
-		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
-	}
-	// parse port
-	port := binary.BigEndian.Uint16(buf[reqEnd-2 : reqEnd])
-	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if host, _, err = parseSSAddr(buf[:reqEnd]); err != nil {
+		return
+	}
 	// if specified one time auth enabled, we should verify this
 	if auth || addrType&ss.OneTimeAuthMask > 0 {
 		ota = true
+		oc, ok := conn.(otaConn)
+		if !ok {
+			err = errors.New("one time auth is not supported by this cipher")
+			return
+		}
 		if _, err = io.ReadFull(conn, buf[reqEnd:reqEnd+lenHmacSha1]); err != nil {
 			return
 		}
-		iv := conn.GetIv()
-		key := conn.GetKey()
+		iv := oc.GetIv()
+		key := oc.GetKey()
 		actualHmacSha1Buf := ss.HmacSha1(append(iv, key...), buf[:reqEnd])
 		if !bytes.Equal(buf[reqEnd:reqEnd+lenHmacSha1], actualHmacSha1Buf) {
 			err = fmt.Errorf("verify one time auth failed, iv=%v key=%v data=%v", iv, key, buf[:reqEnd])
@@ -104,8 +124,19 @@ func getSSRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	return
 }
 
-func handleSSConnection(conn *ss.Conn, auth bool) {
-	Debug.Printf("[ss]: new client %s->%s\n", conn.LocalAddr(), conn.RemoteAddr().String())
+// handleSSConnection pipes a ss session bounded by p, it returns its
+// record without the key, nil if no target is requested.
+func handleSSConnection(l Logger, conn net.Conn, auth bool, p sessionPolicy) *SessionRecord {
+	l = l.With("local", conn.LocalAddr(), "client", conn.RemoteAddr())
+	l.Debug("new client")
+	rec := &SessionRecord{Start: time.Now()}
+	// the session ends before piping
+	refused := func(reason CloseReason, err error) *SessionRecord {
+		rec.End = time.Now()
+		rec.Reason = reason
+		rec.Err = err.Error()
+		return rec
+	}
 	closed := false
 	closeConn := func(conn net.Conn) {
 		if !closed {
@@ -114,59 +145,101 @@ func handleSSConnection(conn *ss.Conn, auth bool) {
 	}
 	defer closeConn(conn)
 
+	// the request is bounded by the first timeout
+	if d := p.timeouts.first(); d > 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
 	host, ota, err := getSSRequest(conn, auth)
+	rec.Target = host
 	if err != nil {
-		log.Printf("[ss]: error getting request %s->%s: %s\n", conn.LocalAddr(), conn.RemoteAddr(), err)
-		return
+		l.Error("get request failed", "err", err)
+		if host == "" {
+			return nil
+		}
+		return refused(CloseBadRequest, err)
 	}
+	conn.SetReadDeadline(time.Time{})
 
-	Debug.Printf("[ss]: connecting %s\n", host)
+	l = l.With("target", host)
+	l.Debug("connecting")
 
-	// TODO: support udp
-	remote, err := net.Dial("tcp", host)
+	remote, err := dialTarget(l, p, "tcp", host)
+	if err == aclDeniedErr {
+		return refused(CloseDenied, err)
+	}
 	if err != nil {
-		log.Printf("[ss]: connect to %s error: %s\n", host, err)
-		return
+		countDialErr(host, err)
+		l.Error("connect failed", "err", err)
+		return refused(CloseDialError, err)
 	}
 	defer closeConn(remote)
 
-	Debug.Printf("[ss]: piping local[%s]<->remote[%s] ota=%v connOta=%v\n", conn.LocalAddr(), host, ota, conn.IsOta())
+	l.Debug("piping", "ota", ota)
 
-	if ota {
-		log.Println("[ss] ota not supported")
-		return
+	st := newSessionTimer(p.timeouts, conn, remote)
+	res := relay(l, conn, remote, ota, st, p.up, p.down)
+	rec.End = time.Now()
+	rec.BytesUp, rec.BytesDown = res.up, res.down
+	rec.Reason = res.reason
+	if res.err != nil && res.reason != CloseEOF {
+		rec.Err = res.err.Error()
 	}
-
-	go func() {
-		PipeThenClose(conn, remote)
-		Debug.Printf("[ss]: piping local[%s]->remote[%s] return\n",
-			conn.LocalAddr(), host)
-	}()
-	PipeThenClose(remote, conn)
-	Debug.Printf("[ss]: piping remote[%s]->local[%s] return\n",
-		host, conn.LocalAddr())
+	if rec.Reason.timeout() {
+		sessionTimeouts.add(1, "cause", rec.Reason.String())
+		l.Info("session timed out", "cause", rec.Reason, "up", rec.BytesUp,
+			"down", rec.BytesDown, "duration", rec.End.Sub(rec.Start))
+	} else {
+		l.Debug("session ends", "up", rec.BytesUp, "down", rec.BytesDown,
+			"reason", rec.Reason, "duration", rec.End.Sub(rec.Start))
+	}
+	return rec
 }
 
-func HandleSSConnectRequest(clientAddr, key string) {
-	Debug.Printf("[ss]: handle ss connection request, clientAddr[%s], key[%s]\n",
-		clientAddr, key)
-	conn, err := makeSSTunnel(clientAddr, key)
+func (s *srv) HandleSSConnectRequest(clientAddr, key string) {
+	l := s.logger("ss").With("conn", nextConnID(), "key", key)
+	l.Debug("handle ss connection request", "client", clientAddr)
+	if s.isClosing() {
+		l.Debug("server is shutting down, drop request")
+		return
+	}
+	conn, err := makeSSTunnel(l, clientAddr, key, s.dataTLS)
 	if err != nil {
-		log.Printf("[ss]: make tunnel failed: %s\n", err)
+		l.Error("make tunnel failed", "err", err)
 		return
 	}
-	handleSSConnection(ss.NewConn(conn, cipher.Copy()), false)
+	if !s.addConn(conn) {
+		conn.Close()
+		return
+	}
+	defer s.removeConn(conn)
+
+	p := sessionPolicy{acl: s.acl, resolver: s.resolver, timeouts: s.timeouts}
+	p.up, p.down = s.limiter.acquire(key)
+	defer s.limiter.release(key)
+
+	rec := handleSSConnection(l, s.cipher.newConn(conn), false, p)
+	if rec != nil {
+		rec.Key = key
+		s.recordSession(*rec)
+	}
 }
 
 var establishError = errors.New("establish tunnel failed")
 
-func makeSSTunnel(clientAddr, key string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", clientAddr)
+var connSeq uint64
+
+// nextConnID returns the id of a new data connection in the logs.
+func nextConnID() uint64 {
+	return atomic.AddUint64(&connSeq, 1)
+}
+
+func makeSSTunnel(l Logger, clientAddr, key string, c *tls.Config) (net.Conn, error) {
+	conn, err := dial(clientAddr, c)
 	if err != nil {
 		return nil, err
 	}
 
-	if !establishTunnel(conn, key) {
+	if !establishTunnel(l, conn, key) {
 		conn.Close()
 		return nil, establishError
 	}
@@ -174,12 +247,12 @@ func makeSSTunnel(clientAddr, key string) (net.Conn, error) {
 	return conn, nil
 }
 
-func establishTunnel(conn net.Conn, reqAddr string) bool {
+func establishTunnel(l Logger, conn net.Conn, reqAddr string) bool {
 	d, err := json.Marshal(&struct {
 		Addr string `json:"socketkey"`
 	}{reqAddr})
 	if err != nil {
-		log.Printf("[ss]: marshal address[%s] failed: %s\n", reqAddr, err)
+		l.Error("marshal key failed", "key", reqAddr, "err", err)
 		return false
 	}
 
@@ -187,25 +260,25 @@ func establishTunnel(conn net.Conn, reqAddr string) bool {
 
 	err = binary.Write(&b, binary.BigEndian, uint16(binary.Size(d)))
 	if err != nil {
-		log.Printf("[ss]: write marshaled key length failed: %s\n", err)
+		l.Error("write marshaled key length failed", "err", err)
 		return false
 	}
 	_, err = b.Write(d)
 	if err != nil {
-		log.Printf("[ss]: write marshaled key[%s] failed: %s\n", string(d), err)
+		l.Error("write marshaled key failed", "key", reqAddr, "err", err)
 		return false
 	}
 
 	_, err = conn.Write(b.Bytes())
 	if err != nil {
-		log.Printf("[ss]: write connection failed: %s\n", err)
+		l.Error("write connection failed", "err", err)
 		return false
 	}
 
 	var buf [3]byte
 	n, err := conn.Read(buf[:])
 	if err != nil {
-		log.Printf("[ss]: read response failed: %s\n", err)
+		l.Error("read response failed", "err", err)
 		return false
 	}
 
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"testing"
@@ -14,7 +15,7 @@ import (
 
 func TestGetSSRequest(t *testing.T) {
 	r, w := net.Pipe()
-	sr, sw := ss.NewConn(r, cipher.Copy()), ss.NewConn(w, cipher.Copy())
+	sr, sw := ss.NewConn(r, testCipher()), ss.NewConn(w, testCipher())
 	exit := make(chan struct{})
 	defer close(exit)
 	inputC := make(chan []byte)
@@ -82,14 +83,87 @@ func TestHandleSSConnection(t *testing.T) {
 	for name, f := range map[string]func(*testing.T){
 		"clientClose": testHandleSSConnectionClientClose,
 		"serverClose": testHandleSSConnectionServerClose,
+		"ota":         testHandleSSConnectionOta,
+		"otaTampered": testHandleSSConnectionOtaTampered,
 	} {
 		t.Run(name, f)
 	}
 }
 
-func testHandleSSConnectionClientClose(t *testing.T) {
-	Debug = false
+func TestHandleSSConnectionRefused(t *testing.T) {
+	deny, err := NewACL(DenyPrivateRules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]struct {
+		// written by the client, nil closes it at once
+		req    func(addr string) []byte
+		auth   bool
+		acl    *ACL
+		reason CloseReason
+	}{
+		"noRequest": {},
+		"badRequest": {
+			req: func(addr string) []byte {
+				req, _ := ss.RawAddr(addr)
+				return append(req, make([]byte, lenHmacSha1)...)
+			},
+			auth:   true,
+			reason: CloseBadRequest,
+		},
+		"denied": {
+			req: func(addr string) []byte {
+				req, _ := ss.RawAddr(addr)
+				return req
+			},
+			acl:    deny,
+			reason: CloseDenied,
+		},
+		"dialError": {
+			req: func(addr string) []byte {
+				req, _ := ss.RawAddr(addr)
+				return req
+			},
+			reason: CloseDialError,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			c1, c2 := net.Pipe()
+			sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
+			defer sc2.Close()
+			recs := make(chan *SessionRecord, 1)
+			go func() {
+				recs <- handleSSConnection(ssLog, sc1, c.auth, sessionPolicy{acl: c.acl})
+			}()
+
+			// nothing listens on it
+			const addr = "127.0.0.1:1"
+			if c.req == nil {
+				sc2.Close()
+				if rec := <-recs; rec != nil {
+					t.Errorf("expect no record, but got %+v", rec)
+				}
+				return
+			}
+			if _, err := sc2.Write(c.req(addr)); err != nil {
+				t.Fatal(err)
+			}
+			rec := <-recs
+			if rec == nil {
+				t.Fatal("no session record")
+			}
+			if rec.Target != addr || rec.Reason != c.reason || rec.Err == "" ||
+				rec.Start.IsZero() || rec.End.Before(rec.Start) {
+				t.Errorf("unexpected record %+v", rec)
+			}
+		})
+	}
+}
 
+func testHandleSSConnectionClientClose(t *testing.T) {
 	exit := make(chan struct{})
 	defer close(exit)
 
@@ -114,20 +188,23 @@ func testHandleSSConnectionClientClose(t *testing.T) {
 
 		// echo
 		io.Copy(conn, conn)
+		conn.Close()
 
 		<-exit
 	}()
 
 	c1, c2 := net.Pipe()
-	sc1, sc2 := ss.NewConn(c1, cipher.Copy()), ss.NewConn(c2, cipher.Copy())
+	sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
 
 	done := make(chan struct{})
+	var rec *SessionRecord
 	go func() {
-		handleSSConnection(sc1, false)
+		rec = handleSSConnection(ssLog, sc1, false, sessionPolicy{})
 		close(done)
 	}()
 
-	req, err := ss.RawAddr(<-serverAddr)
+	addr := <-serverAddr
+	req, err := ss.RawAddr(addr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -162,10 +239,19 @@ func testHandleSSConnectionClientClose(t *testing.T) {
 	}
 
 	<-done
+	if rec == nil {
+		t.Fatal("no session record")
+	}
+	if rec.Target != addr || rec.Reason != CloseEOF || rec.Err != "" ||
+		rec.BytesUp != int64(len(content)) || rec.BytesDown != int64(len(content)) {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec.End.Before(rec.Start) {
+		t.Errorf("session ends at %v before it starts at %v", rec.End, rec.Start)
+	}
 }
 
 func testHandleSSConnectionServerClose(t *testing.T) {
-	Debug = false
 	const content = "hello"
 
 	exit := make(chan struct{})
@@ -205,11 +291,11 @@ func testHandleSSConnectionServerClose(t *testing.T) {
 	}()
 
 	c1, c2 := net.Pipe()
-	sc1, sc2 := ss.NewConn(c1, cipher.Copy()), ss.NewConn(c2, cipher.Copy())
+	sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
 
 	done := make(chan struct{})
 	go func() {
-		handleSSConnection(sc1, false)
+		handleSSConnection(ssLog, sc1, false, sessionPolicy{})
 		close(done)
 	}()
 
@@ -244,6 +330,177 @@ func testHandleSSConnectionServerClose(t *testing.T) {
 	<-done
 }
 
+func testHandleSSConnectionOta(t *testing.T) {
+	exit := make(chan struct{})
+	defer close(exit)
+
+	serverAddr := make(chan string)
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		defer l.Close()
+
+		// inform
+		serverAddr <- l.Addr().String()
+
+		// Wait for a connection.
+		conn, err := l.Accept()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		// echo
+		io.Copy(conn, conn)
+		conn.Close()
+
+		<-exit
+	}()
+
+	c1, c2 := net.Pipe()
+	sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
+
+	done := make(chan struct{})
+	go func() {
+		handleSSConnection(ssLog, sc1, false, sessionPolicy{})
+		close(done)
+	}()
+
+	iv, err := writeOtaRequest(sc2, <-serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send content in chunks
+	const content = "hello"
+	for i, part := range []string{content[:2], content[2:]} {
+		_, err = sc2.Write(otaChunk(iv, uint32(i), []byte(part)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// receive what we write
+	buf := make([]byte, len(content))
+	_, err = io.ReadFull(sc2, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(buf); got != content {
+		t.Errorf("got[%s] not our expected[%s]", got, content)
+	}
+
+	err = sc2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+}
+
+func testHandleSSConnectionOtaTampered(t *testing.T) {
+	received := make(chan []byte, 1)
+	serverAddr := make(chan string)
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		defer l.Close()
+
+		// inform
+		serverAddr <- l.Addr().String()
+
+		// Wait for a connection.
+		conn, err := l.Accept()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	c1, c2 := net.Pipe()
+	sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
+
+	done := make(chan struct{})
+	go func() {
+		handleSSConnection(ssLog, sc1, false, sessionPolicy{})
+		close(done)
+	}()
+
+	iv, err := writeOtaRequest(sc2, <-serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first chunk is fine, the second one is tampered
+	_, err = sc2.Write(otaChunk(iv, 0, []byte("he")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := otaChunk(iv, 1, []byte("llo"))
+	chunk[len(chunk)-1] ^= 0xff
+	_, err = sc2.Write(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connection should be closed by the server
+	_, err = sc2.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("expect connection closed, but not")
+	}
+	<-done
+
+	if got := string(<-received); got != "he" {
+		t.Errorf("remote got[%s], but expect[he]", got)
+	}
+}
+
+// writeOtaRequest sends the one time auth request header of addr,
+// returns the iv used by conn.
+func writeOtaRequest(conn *ss.Conn, addr string) ([]byte, error) {
+	// flush iv first, then we know it
+	if _, err := conn.Write(nil); err != nil {
+		return nil, err
+	}
+	iv := conn.GetIv()
+
+	req, err := ss.RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	req[0] |= ss.OneTimeAuthMask
+	req = append(req, ss.HmacSha1(append(iv, conn.GetKey()...), req)...)
+	_, err = conn.Write(req)
+	return iv, err
+}
+
+func otaChunk(iv []byte, id uint32, data []byte) []byte {
+	b := make([]byte, lenOtaChunkHeader, lenOtaChunkHeader+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	var chunkId [4]byte
+	binary.BigEndian.PutUint32(chunkId[:], id)
+	copy(b[lenOtaDataLen:], ss.HmacSha1(append(iv, chunkId[:]...), data))
+	return append(b, data...)
+}
+
+func testCipher() *ss.Cipher {
+	c, err := ss.NewCipher(defaultSSMethod, defaultSSPassword)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
 func translateIpv4(addr string) ([]byte, error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -308,7 +565,7 @@ func TestEstablishTunnel(t *testing.T) {
 
 	// normal case
 	todo <- func() bool {
-		return establishTunnel(c2, key)
+		return establishTunnel(ssLog, c2, key)
 	}
 	n, err := c1.Read(buf[:])
 	if err != nil {
@@ -327,7 +584,7 @@ func TestEstablishTunnel(t *testing.T) {
 
 	// wrong ack
 	todo <- func() bool {
-		return establishTunnel(c2, key)
+		return establishTunnel(ssLog, c2, key)
 	}
 	n, err = c1.Read(buf[:])
 	if err != nil {
@@ -346,7 +603,7 @@ func TestEstablishTunnel(t *testing.T) {
 
 	// close connection
 	todo <- func() bool {
-		return establishTunnel(c2, key)
+		return establishTunnel(ssLog, c2, key)
 	}
 	c1.Close()
 	if <-result {
@@ -0,0 +1,113 @@
+package proxy_server
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// A task message with an id starts with a header: the id, and in the
+// ones pushed by the plugin, the timeout in milliseconds. The server
+// only keeps the id on the control link if the vm speaks CapTaskID,
+// and reports the tasks without a result in time by TaskTimeout. The
+// tasks pushed without an id get one with localTaskBit set, so that
+// the journal keeps them as well, the plugin never sees it: the ids
+// with the bit are reserved.
+const (
+	lenTaskID      = 4
+	lenTaskTimeout = 4
+
+	localTaskBit = 1 << 31
+)
+
+var badTaskHeaderErr = errors.New("malformed task header")
+
+func appendTaskID(b []byte, id uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, id)
+}
+
+// taskMessage returns the value of a task message with id, data is
+// copied after the header.
+func taskMessage(id uint32, data []byte) []byte {
+	v := make([]byte, 0, lenTaskID+len(data))
+	return append(appendTaskID(v, id), data...)
+}
+
+// parseTaskID splits v into the task id and data.
+func parseTaskID(l Logger, v []byte) (uint32, []byte, error) {
+	if len(v) < lenTaskID {
+		l.Error("task header is too short", "expect", lenTaskID, "len", len(v))
+		return 0, nil, badTaskHeaderErr
+	}
+	return binary.BigEndian.Uint32(v), v[lenTaskID:], nil
+}
+
+// parsePushTask returns the task pushed by the plugin in v.
+func parsePushTask(l Logger, typ RequestType, v []byte) (*Request, error) {
+	id, data, err := parseTaskID(l, v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < lenTaskTimeout {
+		l.Error("task has no timeout", "task", id)
+		return nil, badTaskHeaderErr
+	}
+	ms := binary.BigEndian.Uint32(data)
+	return &Request{
+		Typ:      typ,
+		TaskID:   id,
+		Timeout:  time.Duration(ms) * time.Millisecond,
+		TaskData: data[lenTaskTimeout:],
+	}, nil
+}
+
+// localTaskID returns the id of a task pushed without one, it is only
+// called by Loop.
+func (s *srv) localTaskID() uint32 {
+	s.localTaskSeq = (s.localTaskSeq + 1) &^ localTaskBit
+	return s.localTaskSeq | localTaskBit
+}
+
+// pendingTask is a task sent to the vm waiting for its result.
+type pendingTask struct {
+	// closed once the result arrives
+	done chan struct{}
+}
+
+// trackTask starts the timeout of the task in req, it is only called
+// by Loop.
+func (s *srv) trackTask(req *Request) {
+	if old, ok := s.tasks[req.TaskID]; ok {
+		s.log.Info("task is pushed again", "task", req.TaskID)
+		close(old.done)
+	}
+	t := &pendingTask{done: make(chan struct{})}
+	s.tasks[req.TaskID] = t
+
+	go func(id uint32, c <-chan time.Time) {
+		select {
+		case <-c:
+		case <-t.done:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+		select {
+		case s.reqs <- &Request{Typ: TaskTimeout, TaskID: id}:
+		case <-t.done:
+		case <-s.ctx.Done():
+		}
+	}(req.TaskID, s.clock.After(req.Timeout))
+}
+
+// finishTask stops tracking task id, it returns false if the task is
+// not pending (e.g. it timed out already).
+func (s *srv) finishTask(id uint32) bool {
+	t, ok := s.tasks[id]
+	if !ok {
+		return false
+	}
+	close(t.done)
+	delete(s.tasks, id)
+	return true
+}
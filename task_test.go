@@ -0,0 +1,129 @@
+package proxy_server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePushTask(t *testing.T) {
+	for name, c := range map[string]struct {
+		v      []byte
+		err    error
+		expect *Request
+	}{
+		"ok": {
+			v: []byte{0, 0, 0, 7, 0, 0, 0x3, 0xe8, 1, 2},
+			expect: &Request{
+				Typ:      PushTask,
+				TaskID:   7,
+				Timeout:  time.Second,
+				TaskData: []byte{1, 2},
+			},
+		},
+		"noID": {
+			v:   []byte{0, 0, 7},
+			err: badTaskHeaderErr,
+		},
+		"noTimeout": {
+			v:   []byte{0, 0, 0, 7, 0, 0},
+			err: badTaskHeaderErr,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parsePushTask(pluginLog, PushTask, c.v)
+			if err != c.err {
+				t.Errorf("expect error %v, but got %v", c.err, err)
+			}
+			if !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("expect %#v, but got %#v", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestTaskTimeout(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	clk := newFakeClock()
+	s.clock = clk
+	pr, pw := net.Pipe()
+	setPluginConn(s, pw)
+	s.pluginFeat.Store(LocalFeatures)
+	tr, tw := net.Pipe()
+	setTunnelConn(s, tw)
+	s.tunnelFeat.Store(LocalFeatures)
+	<-s.tunnelErr
+	go s.Loop()
+
+	push := func(id uint32) fakeTimer {
+		s.reqs <- &Request{Typ: PushTask, TaskID: id, Timeout: time.Second, TaskData: []byte{1}}
+		expect := TLV{T: tTaskID, L: 5, V: []byte{0, 0, 0, byte(id), 1}}
+		got, err := ReadTLV(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+		ft := clk.next(t)
+		if ft.d != time.Second {
+			t.Errorf("expect timeout %s, but got %s", time.Second, ft.d)
+		}
+		return ft
+	}
+
+	// task 1 gets its result in time
+	ft1 := push(1)
+	s.reqs <- &Request{Typ: TaskResult, TaskID: 1, TaskData: []byte{2}}
+	expect := TLV{T: pTaskResultID, L: 5, V: []byte{0, 0, 0, 1, 2}}
+	got, err := ReadTLV(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+	// its timer fires late, nothing is reported
+	ft1.c <- time.Now()
+
+	// task 2 times out
+	ft2 := push(2)
+	ft2.c <- time.Now()
+	expect = TLV{T: pTaskTimeout, L: 4, V: []byte{0, 0, 0, 2}}
+	got, err = ReadTLV(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+
+	// a suppressed push of task 3 keeps its timeout, the late result of
+	// task 2 is dropped
+	push(3)
+	s.reqs <- &Request{Typ: PushTask, TaskID: 3, Timeout: time.Second, TaskData: []byte{1}}
+	s.reqs <- &Request{Typ: TaskResult, TaskID: 2, TaskData: []byte{2}}
+	s.reqs <- &Request{Typ: TaskResult, TaskID: 3, TaskData: []byte{2}}
+	expect = TLV{T: pTaskResultID, L: 5, V: []byte{0, 0, 0, 3, 2}}
+	got, err = ReadTLV(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+	select {
+	case ft := <-clk.afters:
+		t.Errorf("unexpected timeout %s of the suppressed push", ft.d)
+	default:
+	}
+}
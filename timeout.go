@@ -0,0 +1,172 @@
+package proxy_server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionTimeouts bound the ss sessions, 0 means no bound.
+type SessionTimeouts struct {
+	// Idle: no byte is relayed either way, halfCloseIdle if 0 once a
+	// side half closes, so that the other one can't keep it forever
+	Idle time.Duration
+	// Read: no byte is read in one direction
+	Read time.Duration
+	// Lifetime: since the session starts
+	Lifetime time.Duration
+}
+
+var (
+	halfCloseIdle = 5 * time.Minute
+
+	badTimeoutErr = errors.New("timeout is negative")
+)
+
+// WithSessionTimeouts bounds each ss session of the server by t.
+func WithSessionTimeouts(t SessionTimeouts) ServerOption {
+	return func(s *srv) error {
+		if err := t.validate(); err != nil {
+			return err
+		}
+		s.timeouts = t
+		return nil
+	}
+}
+
+func (t SessionTimeouts) validate() error {
+	if t.Idle < 0 || t.Read < 0 || t.Lifetime < 0 {
+		return badTimeoutErr
+	}
+	return nil
+}
+
+// first returns the shortest of the timeouts, 0 if there is none.
+func (t SessionTimeouts) first() time.Duration {
+	var d time.Duration
+	for _, v := range []time.Duration{t.Idle, t.Read, t.Lifetime} {
+		if v > 0 && (d == 0 || v < d) {
+			d = v
+		}
+	}
+	return d
+}
+
+// sessionTimer applies the timeouts to a session: each read is bounded
+// by the read timeout, the connections are closed once the session is
+// idle or too old. A nil one applies none.
+type sessionTimer struct {
+	t     SessionTimeouts
+	conns []net.Conn
+	// unix nanoseconds of the last read
+	last int64
+
+	lock sync.Mutex
+	// done once expired or stopped
+	done    bool
+	expired bool
+	reason  CloseReason
+	// the idle timeout in effect, 0 means none
+	idleAfter time.Duration
+	idle      *time.Timer
+	lifetime  *time.Timer
+}
+
+func newSessionTimer(t SessionTimeouts, conns ...net.Conn) *sessionTimer {
+	st := &sessionTimer{t: t, conns: conns}
+	st.touch()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if t.Idle > 0 {
+		st.idleAfter = t.Idle
+		st.idle = time.AfterFunc(t.Idle, st.checkIdle)
+	}
+	if t.Lifetime > 0 {
+		st.lifetime = time.AfterFunc(t.Lifetime, func() { st.expire(CloseLifetime) })
+	}
+	return st
+}
+
+// splice reports whether the reads may go without a deadline or a
+// trace, e.g. in the kernel.
+func (st *sessionTimer) splice() bool {
+	return st == nil || (st.t.Read == 0 && st.t.Idle == 0)
+}
+
+// beforeRead sets the read deadline of c.
+func (st *sessionTimer) beforeRead(c net.Conn) {
+	if st != nil && st.t.Read > 0 {
+		c.SetReadDeadline(time.Now().Add(st.t.Read))
+	}
+}
+
+// touch records the session is active now.
+func (st *sessionTimer) touch() {
+	if st != nil {
+		atomic.StoreInt64(&st.last, time.Now().UnixNano())
+	}
+}
+
+// halfClose bounds the session by halfCloseIdle once a side half
+// closes, unless it is bounded by an idle timeout already.
+func (st *sessionTimer) halfClose() {
+	if st == nil {
+		return
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.done || st.idle != nil {
+		return
+	}
+	st.idleAfter = halfCloseIdle
+	st.idle = time.AfterFunc(halfCloseIdle, st.checkIdle)
+}
+
+func (st *sessionTimer) checkIdle() {
+	last := time.Unix(0, atomic.LoadInt64(&st.last))
+	st.lock.Lock()
+	if left := st.idleAfter - time.Since(last); left > 0 {
+		if !st.done {
+			st.idle.Reset(left)
+		}
+		st.lock.Unlock()
+		return
+	}
+	st.lock.Unlock()
+	st.expire(CloseIdle)
+}
+
+// expire ends the session for reason by closing its connections.
+func (st *sessionTimer) expire(reason CloseReason) {
+	st.lock.Lock()
+	if st.done {
+		st.lock.Unlock()
+		return
+	}
+	st.done, st.expired, st.reason = true, true, reason
+	st.lock.Unlock()
+
+	for _, c := range st.conns {
+		c.Close()
+	}
+}
+
+// stop stops the timers, it returns the reason the session expired
+// for, if it did.
+func (st *sessionTimer) stop() (CloseReason, bool) {
+	if st == nil {
+		return CloseEOF, false
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.done = true
+	if st.idle != nil {
+		st.idle.Stop()
+	}
+	if st.lifetime != nil {
+		st.lifetime.Stop()
+	}
+	return st.reason, st.expired
+}
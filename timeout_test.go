@@ -0,0 +1,123 @@
+package proxy_server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRelayTimeouts(t *testing.T) {
+	for name, c := range map[string]struct {
+		timeouts SessionTimeouts
+		// the client writes a byte every interval, count times
+		count    int
+		interval time.Duration
+		expect   CloseReason
+	}{
+		"idle": {
+			timeouts: SessionTimeouts{Idle: 50 * time.Millisecond},
+			expect:   CloseIdle,
+		},
+		"idleActive": {
+			timeouts: SessionTimeouts{Idle: 100 * time.Millisecond},
+			count:    5,
+			interval: 40 * time.Millisecond,
+			expect:   CloseIdle,
+		},
+		"read": {
+			timeouts: SessionTimeouts{Read: 50 * time.Millisecond},
+			expect:   CloseTimeout,
+		},
+		"lifetime": {
+			timeouts: SessionTimeouts{Idle: time.Hour, Lifetime: 100 * time.Millisecond},
+			count:    10,
+			interval: 20 * time.Millisecond,
+			expect:   CloseLifetime,
+		},
+		"lifetimeSplice": {
+			timeouts: SessionTimeouts{Lifetime: 50 * time.Millisecond},
+			expect:   CloseLifetime,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client, relayClient := tcpPair(t)
+			relayTarget, target := tcpPair(t)
+			defer client.Close()
+			defer target.Close()
+			go io.Copy(io.Discard, target)
+
+			start := time.Now()
+			done := make(chan relayResult, 1)
+			go func() {
+				st := newSessionTimer(c.timeouts, relayClient, relayTarget)
+				done <- relay(pipeLog, relayClient, relayTarget, false, st, nil, nil)
+			}()
+			for i := 0; i < c.count; i++ {
+				client.Write([]byte{1})
+				time.Sleep(c.interval)
+			}
+
+			select {
+			case res := <-done:
+				if res.reason != c.expect {
+					t.Errorf("expect %v, but got %+v", c.expect, res)
+				}
+				if active := time.Duration(c.count) * c.interval; time.Since(start) < active &&
+					c.expect == CloseIdle {
+					t.Errorf("session expires in %v while it is active", time.Since(start))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("session doesn't time out")
+			}
+		})
+	}
+}
+
+func TestRelayHalfCloseIdle(t *testing.T) {
+	old := halfCloseIdle
+	halfCloseIdle = 50 * time.Millisecond
+	t.Cleanup(func() { halfCloseIdle = old })
+
+	for name, c := range map[string]struct {
+		// the target answers a byte every interval, count times
+		count    int
+		interval time.Duration
+	}{
+		"idle":   {},
+		"active": {count: 5, interval: 20 * time.Millisecond},
+	} {
+		client, relayClient := tcpPair(t)
+		relayTarget, target := tcpPair(t)
+		go io.Copy(io.Discard, client)
+
+		start := time.Now()
+		done := make(chan relayResult, 1)
+		go func() {
+			st := newSessionTimer(SessionTimeouts{}, relayClient, relayTarget)
+			done <- relay(pipeLog, bufferedConn{relayClient}, bufferedConn{relayTarget}, false, st, nil, nil)
+		}()
+		// the client half closes, the target never does
+		client.CloseWrite()
+		for i := 0; i < c.count; i++ {
+			target.Write([]byte{1})
+			time.Sleep(c.interval)
+		}
+
+		select {
+		case res := <-done:
+			if res.reason != CloseIdle {
+				t.Errorf("%s: expect %v, but got %+v", name, CloseIdle, res)
+			}
+			if active := time.Duration(c.count) * c.interval; time.Since(start) < active {
+				t.Errorf("%s: session expires in %v while it is active", name, time.Since(start))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: session doesn't time out", name)
+		}
+		client.Close()
+		target.Close()
+	}
+}
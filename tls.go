@@ -0,0 +1,95 @@
+package proxy_server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+var (
+	dialTimeout = 10 * time.Second
+
+	noCAErr      = errors.New("no certificate found in ca file")
+	certNoKeyErr = errors.New("certificate and key must be given together")
+)
+
+// NewTLSConfig returns the client side tls config of a link. Only the
+// certificate authorities in caFile are trusted when it is given, the
+// system ones are used otherwise. certFile and keyFile are the client
+// certificate presented to the peer for mutual tls, serverName
+// overrides the name checked in the peer certificate.
+func NewTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, certNoKeyErr
+	}
+
+	c := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, noCAErr
+		}
+		c.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// WithControlTLS dials the control tunnel over tls with config c.
+func WithControlTLS(c *tls.Config) ServerOption {
+	return func(s *srv) error {
+		s.tunnelTLS = c
+		return nil
+	}
+}
+
+// WithDataTLS dials the data connections over tls with config c.
+func WithDataTLS(c *tls.Config) ServerOption {
+	return func(s *srv) error {
+		s.dataTLS = c
+		return nil
+	}
+}
+
+// WithPluginTLS dials the plugin link over tls with config c.
+func WithPluginTLS(c *tls.Config) ServerOption {
+	return func(s *srv) error {
+		s.pluginTLS = c
+		return nil
+	}
+}
+
+// dial connects to addr, over tls if c is not nil, the tls handshake
+// is done before it returns.
+func dial(addr string, c *tls.Config) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c == nil {
+		conn, err = d.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, c)
+	}
+	if err != nil {
+		countDialErr(addr, err)
+	}
+	return conn, err
+}
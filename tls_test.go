@@ -0,0 +1,292 @@
+package proxy_server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// newTestCert issues a certificate for 127.0.0.1 signed by parent, it
+// is self signed if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+type testPKI struct {
+	dir                   string
+	ca, server, client    *testCert
+	caFile                string
+	clientCert, clientKey string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	p := &testPKI{dir: t.TempDir()}
+	p.ca = newTestCert(t, "ca", nil)
+	p.server = newTestCert(t, "server", p.ca)
+	p.client = newTestCert(t, "client", p.ca)
+
+	p.caFile = p.write(t, "ca.pem", p.ca.certPEM)
+	p.clientCert = p.write(t, "client.pem", p.client.certPEM)
+	p.clientKey = p.write(t, "client.key", p.client.keyPEM)
+	return p
+}
+
+func (p *testPKI) write(t *testing.T, name string, b []byte) string {
+	path := filepath.Join(p.dir, name)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// listen starts a tls listener with the server certificate, client
+// certificates are required if mutual is set.
+func (p *testPKI) listen(t *testing.T, mutual bool) net.Listener {
+	c := &tls.Config{
+		Certificates: []tls.Certificate{p.server.tlsCertificate(t)},
+	}
+	if mutual {
+		pool := x509.NewCertPool()
+		pool.AddCert(p.ca.cert)
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	p := newTestPKI(t)
+	bad := p.write(t, "bad.pem", []byte("foo"))
+
+	for name, c := range map[string]struct {
+		ca, cert, key string
+		shouldErr     bool
+	}{
+		"system":    {},
+		"pinned":    {ca: p.caFile},
+		"mutual":    {ca: p.caFile, cert: p.clientCert, key: p.clientKey},
+		"noCA":      {ca: filepath.Join(p.dir, "none"), shouldErr: true},
+		"badCA":     {ca: bad, shouldErr: true},
+		"certNoKey": {ca: p.caFile, cert: p.clientCert, shouldErr: true},
+		"badKey":    {cert: p.clientCert, key: bad, shouldErr: true},
+	} {
+		got, err := NewTLSConfig(c.ca, c.cert, c.key, "")
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%s: expect error %v, but got %v", name, c.shouldErr, err)
+			continue
+		}
+		if c.shouldErr {
+			continue
+		}
+		if (got.RootCAs != nil) != (c.ca != "") {
+			t.Errorf("%s: expect pinned ca %v", name, c.ca != "")
+		}
+		if (len(got.Certificates) != 0) != (c.cert != "") {
+			t.Errorf("%s: expect client certificate %v", name, c.cert != "")
+		}
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	p := newTestPKI(t)
+	other := newTestPKI(t)
+
+	for name, c := range map[string]struct {
+		pki       *testPKI
+		mutual    bool
+		clientCrt bool
+		shouldErr bool
+	}{
+		"pinned":          {pki: p},
+		"mutual":          {pki: p, mutual: true, clientCrt: true},
+		"mutualNoCert":    {pki: p, mutual: true, shouldErr: true},
+		"untrustedServer": {pki: other, shouldErr: true},
+	} {
+		l := c.pki.listen(t, c.mutual)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			// echo one byte once the handshake is done
+			b := make([]byte, 1)
+			if _, err := io.ReadFull(conn, b); err == nil {
+				conn.Write(b)
+			}
+		}()
+
+		var cert, key string
+		if c.clientCrt {
+			cert, key = p.clientCert, p.clientKey
+		}
+		tc, err := NewTLSConfig(p.caFile, cert, key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := dial(l.Addr().String(), tc)
+		if err == nil {
+			// with tls 1.3 the server rejects the client certificate
+			// after the client handshake is done
+			_, err = conn.Write([]byte{1})
+			if err == nil {
+				_, err = io.ReadFull(conn, make([]byte, 1))
+			}
+			conn.Close()
+		}
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%s: expect error %v, but got %v", name, c.shouldErr, err)
+		}
+		l.Close()
+	}
+}
+
+func TestServerTLSLinks(t *testing.T) {
+	p := newTestPKI(t)
+	tc, err := NewTLSConfig(p.caFile, p.clientCert, p.clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := p.listen(t, true)
+	defer pl.Close()
+	cl := p.listen(t, true)
+	defer cl.Close()
+	dl := p.listen(t, true)
+	defer dl.Close()
+
+	accepted := make(chan net.Conn, 2)
+	for _, l := range []net.Listener{pl, cl} {
+		l := l
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// finish the handshake
+			conn.(*tls.Conn).Handshake()
+			accepted <- conn
+		}()
+	}
+
+	s, err := NewServer(pl.Addr().String(), cl.Addr().String(), dl.Addr().String(),
+		WithPluginTLS(tc), WithControlTLS(tc), WithDataTLS(tc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+	go s.Loop()
+
+	// the plugin is told once the control tunnel is up
+	plugin := <-accepted
+	defer plugin.Close()
+	control := <-accepted
+	defer control.Close()
+	expectAnnounce(t, plugin, pFeaturesAck)
+	got, err := ReadTLV(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.T != pTunnelConnectOk {
+		t.Errorf("expect tunnel connect ok, but got %#v", got)
+	}
+
+	// request a data connection, the socket key comes over tls
+	const key = "foo"
+	err = WriteTLV(control, TLV{T: tCreateSSConnect, L: uint32(len(key)), V: []byte(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := dl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	var l uint16
+	if err = binary.Read(data, binary.BigEndian, &l); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, l)
+	if _, err = io.ReadFull(data, b); err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		Key string `json:"socketkey"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Key != key {
+		t.Errorf("expect socket key %s, but got %s", key, v.Key)
+	}
+}
@@ -1,91 +1,159 @@
 package proxy_server
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"net"
+	"sync"
 )
 
+// TLV is a message of the control and plugin links. A value longer
+// than maxShortLen is written in the extended form: the type has
+// extLenFlag set and is followed by a 4 bytes length.
 type TLV struct {
 	T uint16
-	L uint16
+	L uint32
 	V []byte
 }
 
-var lengthMismatchErr = errors.New("length is mismatch")
+const (
+	extLenFlag  = 0x8000
+	maxShortLen = 0xffff
 
-func WriteTLV(w io.Writer, tlv TLV) error {
-	Debug.Printf("[tlv]: write %#v\n", tlv)
-	// TODO: use buffer pool
-	var b bytes.Buffer
+	lenHeader    = 4 // type + length
+	lenExtHeader = 6 // type + extended length
 
-	if int(tlv.L) != binary.Size(tlv.V) {
-		log.Printf("[tlv]: length mismatch expect[%d], but got[%d]\n",
-			binary.Size(tlv.V), int(tlv.L))
-		return lengthMismatchErr
+	// DefaultMaxMessageSize is the largest value a TLV may carry unless
+	// the codec is told otherwise, both directions refuse the bigger
+	// ones.
+	DefaultMaxMessageSize = 16 << 20
+)
+
+var (
+	lengthMismatchErr = errors.New("length is mismatch")
+	tooLargeErr       = errors.New("message is too large")
+	badMaxSizeErr     = errors.New("max message size is not positive")
+)
+
+// WithMaxMessageSize sets the largest value of the messages on both
+// links of the server, DefaultMaxMessageSize otherwise.
+func WithMaxMessageSize(n int) ServerOption {
+	return func(s *srv) error {
+		if n <= 0 {
+			return badMaxSizeErr
+		}
+		s.maxMessageSize = n
+		return nil
 	}
+}
 
-	err := binary.Write(&b, binary.BigEndian, tlv.T)
-	if err != nil {
-		log.Printf("[tlv]: write type[%#x] error: %s\n", tlv.T, err)
-		return err
+// fitsPeer reports whether a value of n bytes can be sent to a peer
+// speaking f, only the ones with CapLargePayload read extended TLVs.
+func fitsPeer(n int, f Features) error {
+	if n > maxShortLen && !f.Has(CapLargePayload) {
+		return unsupportedErr
 	}
+	return nil
+}
 
-	err = binary.Write(&b, binary.BigEndian, tlv.L)
-	if err != nil {
-		log.Printf("[tlv]: write length[%#x] error: %s\n", tlv.L, err)
-		return err
+// checkTLV validates the length of tlv before it is written, its value
+// is max bytes at most.
+func checkTLV(l Logger, tlv TLV, max int) error {
+	if int(tlv.L) != len(tlv.V) {
+		l.Error("length mismatch", "expect", len(tlv.V), "len", tlv.L)
+		return lengthMismatchErr
 	}
+	if int64(tlv.L) > int64(max) {
+		l.Error("message is too large to write", "len", tlv.L, "max", max)
+		return tooLargeErr
+	}
+	return nil
+}
 
-	err = binary.Write(&b, binary.BigEndian, tlv.V)
-	if err != nil {
-		log.Printf("[tlv]: write value[%v] error: %s\n", tlv.V, err)
+// appendHeader appends the type and length of tlv to b.
+func appendHeader(b []byte, tlv TLV) []byte {
+	if tlv.L > maxShortLen {
+		b = binary.BigEndian.AppendUint16(b, tlv.T|extLenFlag)
+		return binary.BigEndian.AppendUint32(b, tlv.L)
+	}
+	b = binary.BigEndian.AppendUint16(b, tlv.T)
+	return binary.BigEndian.AppendUint16(b, uint16(tlv.L))
+}
+
+// WriteTLV writes tlv with a single Write, so that it is not
+// interleaved with the ones written concurrently on the same w.
+func WriteTLV(w io.Writer, tlv TLV) error {
+	return writeTLV(tlvLog, w, tlv)
+}
+
+func writeTLV(l Logger, w io.Writer, tlv TLV) error {
+	if l.Enabled(LevelDebug) {
+		l.Debug("write", "tlv", tlv)
+	}
+	if err := checkTLV(l, tlv, DefaultMaxMessageSize); err != nil {
 		return err
 	}
 
-	err = binary.Write(w, binary.BigEndian, b.Bytes())
-	if err != nil {
-		log.Printf("[tlv]: write tlv[%v] error: %s\n", b.Bytes(), err)
+	b := getBuf(lenExtHeader + len(tlv.V))
+	defer putBuf(b)
+	msg := append(appendHeader(b[:0], tlv), tlv.V...)
+	if _, err := w.Write(msg); err != nil {
+		l.Error("write failed", "type", tlv.T, "err", err)
 		return err
 	}
 
 	return nil
 }
 
-func ReadTLV(r io.Reader) (tlv TLV, err error) {
+func ReadTLV(r io.Reader) (TLV, error) {
+	return readTLV(tlvLog, r)
+}
+
+func readTLV(log Logger, r io.Reader) (tlv TLV, err error) {
 	var (
-		t uint16
-		l uint16
-		v []byte
+		t  uint16
+		l  uint32
+		sl uint16
+		v  []byte
 	)
 
 	err = binary.Read(r, binary.BigEndian, &t)
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[tlv]: read type error: %s\n", err)
+			log.Error("read type failed", "err", err)
 		}
 		return
 	}
 
-	err = binary.Read(r, binary.BigEndian, &l)
+	if t&extLenFlag != 0 {
+		t &^= extLenFlag
+		err = binary.Read(r, binary.BigEndian, &l)
+	} else {
+		err = binary.Read(r, binary.BigEndian, &sl)
+		l = uint32(sl)
+	}
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[tlv]: read length error: %s\n", err)
+			log.Error("read length failed", "err", err)
 		}
 		return
 	}
+	if int64(l) > DefaultMaxMessageSize {
+		log.Error("message is too large to read", "len", l, "max", DefaultMaxMessageSize)
+		err = tooLargeErr
+		return
+	}
 
 	v = make([]byte, l)
 	err = binary.Read(r, binary.BigEndian, &v)
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[tlv]: read value error: %s\n", err)
+			log.Error("read value failed", "err", err)
 		}
 		return
 	}
@@ -95,7 +163,242 @@ func ReadTLV(r io.Reader) (tlv TLV, err error) {
 		L: l,
 		V: v,
 	}
-	Debug.Printf("[tlv]: read %#v\n", tlv)
+	if log.Enabled(LevelDebug) {
+		log.Debug("read", "tlv", tlv)
+	}
 
 	return tlv, nil
 }
+
+// The buffers of the messages up to 64KB are pooled by size class, a
+// pool keeps pointers to arrays so that putting one back doesn't
+// allocate.
+var (
+	bufPool4K  = sync.Pool{New: func() interface{} { return new([4 << 10]byte) }}
+	bufPool16K = sync.Pool{New: func() interface{} { return new([16 << 10]byte) }}
+	bufPool64K = sync.Pool{New: func() interface{} { return new([64 << 10]byte) }}
+)
+
+// getBuf returns a buffer of n bytes, putBuf it once done.
+func getBuf(n int) []byte {
+	switch {
+	case n <= 4<<10:
+		return bufPool4K.Get().(*[4 << 10]byte)[:n]
+	case n <= 16<<10:
+		return bufPool16K.Get().(*[16 << 10]byte)[:n]
+	case n <= 64<<10:
+		return bufPool64K.Get().(*[64 << 10]byte)[:n]
+	}
+	return make([]byte, n)
+}
+
+func putBuf(b []byte) {
+	switch cap(b) {
+	case 4 << 10:
+		bufPool4K.Put((*[4 << 10]byte)(b[:cap(b)]))
+	case 16 << 10:
+		bufPool16K.Put((*[16 << 10]byte)(b[:cap(b)]))
+	case 64 << 10:
+		bufPool64K.Put((*[64 << 10]byte)(b[:cap(b)]))
+	}
+}
+
+// TLVCodec reads and writes TLVs on a buffered connection, the header
+// and the value of a message are read and written together. A read
+// interrupted by a temporary error (e.g. a read deadline) is resumed
+// by the next one. A message too large to read fails with tooLargeErr,
+// its value is skipped by the next read. Reads and writes may run
+// concurrently, but not two of the same kind.
+type TLVCodec struct {
+	r *bufio.Reader
+	w *bufio.Writer
+	// the largest value of a message
+	maxSize int
+	log     Logger
+
+	// the message being read when the last read was interrupted
+	part    TLV
+	partOff int
+	partial bool
+	// bytes of a too large value left to skip
+	skip int64
+}
+
+func NewTLVCodec(rw io.ReadWriter) *TLVCodec {
+	return &TLVCodec{
+		r:       bufio.NewReader(rw),
+		w:       bufio.NewWriter(rw),
+		maxSize: DefaultMaxMessageSize,
+		log:     tlvLog,
+	}
+}
+
+// SetMaxMessageSize makes c refuse the messages with a value longer
+// than n bytes, DefaultMaxMessageSize by default.
+func (c *TLVCodec) SetMaxMessageSize(n int) {
+	c.maxSize = n
+}
+
+// SetLogger makes c log to l, the default logger by default.
+func (c *TLVCodec) SetLogger(l Logger) {
+	c.log = l
+}
+
+// Read reads the raw bytes buffered by c, so that c can be used in
+// place of the connection it wraps.
+func (c *TLVCodec) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ReadTLV returns the next message, its value comes from a pool, the
+// caller which doesn't keep it may give it back by ReleaseTLV.
+func (c *TLVCodec) ReadTLV() (TLV, error) {
+	if err := c.skipValue(); err != nil {
+		return TLV{}, err
+	}
+	if !c.partial {
+		tlv, err := c.readHeader()
+		if err != nil {
+			return TLV{}, err
+		}
+		if tlv.L == 0 {
+			tlv.V = []byte{}
+		} else {
+			tlv.V = getBuf(int(tlv.L))
+		}
+		c.part, c.partOff, c.partial = tlv, 0, true
+	}
+
+	for c.partOff < len(c.part.V) {
+		n, err := c.r.Read(c.part.V[c.partOff:])
+		c.partOff += n
+		if err != nil {
+			ne, ok := err.(net.Error)
+			if ok && ne.Temporary() {
+				return TLV{}, err
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.log.Error("read value failed", "err", err)
+			putBuf(c.part.V)
+			c.part, c.partial = TLV{}, false
+			return TLV{}, err
+		}
+	}
+
+	tlv := c.part
+	c.part, c.partial = TLV{}, false
+	if c.log.Enabled(LevelDebug) {
+		c.log.Debug("read", "tlv", tlv)
+	}
+	return tlv, nil
+}
+
+// readHeader consumes the header only once it is complete.
+func (c *TLVCodec) readHeader() (tlv TLV, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		ne, ok := err.(net.Error)
+		if !ok || !ne.Temporary() {
+			c.log.Error("read header failed", "err", err)
+		}
+	}()
+
+	n := lenHeader
+	b, err := c.r.Peek(2)
+	if err == nil && binary.BigEndian.Uint16(b)&extLenFlag != 0 {
+		n = lenExtHeader
+	}
+	if err == nil {
+		b, err = c.r.Peek(n)
+	}
+	if err != nil {
+		if err == io.EOF && len(b) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	tlv.T = binary.BigEndian.Uint16(b)
+	if n == lenExtHeader {
+		tlv.T &^= extLenFlag
+		tlv.L = binary.BigEndian.Uint32(b[2:])
+	} else {
+		tlv.L = uint32(binary.BigEndian.Uint16(b[2:]))
+	}
+	if int64(tlv.L) > int64(c.maxSize) {
+		c.log.Error("message is too large to read, skip it", "type", tlv.T, "len", tlv.L,
+			"max", c.maxSize)
+		c.r.Discard(n)
+		c.skip = int64(tlv.L)
+		return TLV{}, tooLargeErr
+	}
+	_, err = c.r.Discard(n)
+	return
+}
+
+// skipValue discards the rest of a too large value.
+func (c *TLVCodec) skipValue() error {
+	for c.skip > 0 {
+		n := maxShortLen
+		if c.skip < int64(n) {
+			n = int(c.skip)
+		}
+		m, err := c.r.Discard(n)
+		c.skip -= int64(m)
+		if err != nil {
+			ne, ok := err.(net.Error)
+			if ok && ne.Temporary() {
+				return err
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.log.Error("skip value failed", "err", err)
+			c.skip = 0
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTLV writes tlv and flushes it at once.
+func (c *TLVCodec) WriteTLV(tlv TLV) error {
+	if c.log.Enabled(LevelDebug) {
+		c.log.Debug("write", "tlv", tlv)
+	}
+	if err := checkTLV(c.log, tlv, c.maxSize); err != nil {
+		return err
+	}
+
+	// the header is built in place, the buffer is empty after a flush
+	c.w.Write(appendHeader(c.w.AvailableBuffer(), tlv))
+	c.w.Write(tlv.V)
+	if err := c.w.Flush(); err != nil {
+		c.log.Error("write failed", "type", tlv.T, "err", err)
+		return err
+	}
+	return nil
+}
+
+// ReleaseTLV gives the value of tlv back to the pool, it must not be
+// used any more.
+func ReleaseTLV(tlv TLV) {
+	putBuf(tlv.V)
+}
+
+// tlvReader is implemented by TLVCodec, the requests are read through
+// it when the link has one.
+type tlvReader interface {
+	ReadTLV() (TLV, error)
+}
+
+func readMessage(l Logger, r io.Reader) (TLV, error) {
+	if tr, ok := r.(tlvReader); ok {
+		return tr.ReadTLV()
+	}
+	return readTLV(l, r)
+}
@@ -2,6 +2,8 @@ package proxy_server
 
 import (
 	"bytes"
+	"io"
+	"net"
 	"reflect"
 	"sync"
 	"testing"
@@ -70,6 +72,14 @@ func TestReadTLV(t *testing.T) {
 			data:   []byte{0, 1, 0, 2, 3, 4},
 			expect: TLV{T: 1, L: 2, V: []byte{3, 4}},
 		},
+		"extended": {
+			data:   []byte{0x80, 1, 0, 0, 0, 2, 3, 4},
+			expect: TLV{T: 1, L: 2, V: []byte{3, 4}},
+		},
+		"tooLarge": {
+			data:      []byte{0x80, 1, 0xff, 0, 0, 0, 3, 4},
+			expectErr: true,
+		},
 	} {
 		c := c
 		t.Run(name, func(t *testing.T) {
@@ -88,6 +98,34 @@ func TestReadTLV(t *testing.T) {
 	}
 }
 
+func TestLargeTLV(t *testing.T) {
+	v := bytes.Repeat([]byte{0xa}, maxShortLen+1)
+	var b bytes.Buffer
+	err := WriteTLV(&b, TLV{T: 1, L: uint32(len(v)), V: v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []byte{0x80, 1, 0, 1, 0, 0}; !bytes.Equal(b.Bytes()[:6], expect) {
+		t.Errorf("expect header %v, but got %v", expect, b.Bytes()[:6])
+	}
+	got, err := ReadTLV(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.T != 1 || !bytes.Equal(got.V, v) {
+		t.Errorf("extended tlv mismatch: type %#x, %d bytes", got.T, len(got.V))
+	}
+
+	v = make([]byte, DefaultMaxMessageSize+1)
+	err = WriteTLV(&b, TLV{T: 1, L: uint32(len(v)), V: v})
+	if err != tooLargeErr {
+		t.Errorf("expect error %v, but got %v", tooLargeErr, err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("nothing should be written, but got %d bytes", b.Len())
+	}
+}
+
 type concurrentBuffer struct {
 	sync.Mutex
 	bytes.Buffer
@@ -146,3 +184,242 @@ func TestConcurrentWriteTLV(t *testing.T) {
 		}
 	}
 }
+
+func TestCodec(t *testing.T) {
+	tlvs := []TLV{
+		{T: 1, L: 0, V: []byte{}},
+		{T: 2, L: 3, V: []byte{1, 2, 3}},
+		{T: 3, L: maxShortLen + 1, V: bytes.Repeat([]byte{4}, maxShortLen+1)},
+	}
+
+	var b bytes.Buffer
+	c := NewTLVCodec(&b)
+	for _, tlv := range tlvs {
+		if err := c.WriteTLV(tlv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expect := range tlvs {
+		got, err := c.ReadTLV()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("expect %#x/%d, but got %#x/%d", expect.T, expect.L, got.T, got.L)
+		}
+		ReleaseTLV(got)
+	}
+
+	for name, c := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"eof":        {data: []byte{}, err: io.EOF},
+		"shortType":  {data: []byte{0}, err: io.ErrUnexpectedEOF},
+		"shortLen":   {data: []byte{0x80, 1, 0, 0}, err: io.ErrUnexpectedEOF},
+		"shortValue": {data: []byte{0, 1, 0, 2, 3}, err: io.ErrUnexpectedEOF},
+		"tooLarge":   {data: []byte{0x80, 1, 0xff, 0, 0, 0}, err: tooLargeErr},
+	} {
+		_, err := NewTLVCodec(bytes.NewBuffer(c.data)).ReadTLV()
+		if err != c.err {
+			t.Errorf("%s: expect error %v, but got %v", name, c.err, err)
+		}
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+// stepReader returns one chunk per read, and a timeout between them.
+type stepReader struct {
+	chunks  [][]byte
+	timeout bool
+}
+
+func (r *stepReader) Read(b []byte) (int, error) {
+	if r.timeout = !r.timeout; r.timeout {
+		return 0, timeoutErr{}
+	}
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func (r *stepReader) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestCodecResume(t *testing.T) {
+	r := &stepReader{chunks: [][]byte{{0, 1}, {0, 4, 1}, {2, 3}, {4}}}
+	c := NewTLVCodec(r)
+
+	expect := TLV{T: 1, L: 4, V: []byte{1, 2, 3, 4}}
+	for i := 0; ; i++ {
+		got, err := c.ReadTLV()
+		if _, ok := err.(timeoutErr); ok {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+		if i == 0 {
+			t.Fatal("read should be interrupted")
+		}
+		return
+	}
+}
+
+func TestCodecSkipResume(t *testing.T) {
+	r := &stepReader{chunks: [][]byte{{0, 1, 0, 9}, {1, 2, 3, 4}, {5, 6, 7, 8, 9, 0, 2}, {0, 1, 3}}}
+	c := NewTLVCodec(r)
+	c.SetMaxMessageSize(8)
+
+	expect := TLV{T: 2, L: 1, V: []byte{3}}
+	tooLarge := 0
+	for {
+		got, err := c.ReadTLV()
+		if _, ok := err.(timeoutErr); ok {
+			continue
+		}
+		if err == tooLargeErr {
+			tooLarge++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+		if tooLarge != 1 {
+			t.Errorf("expect 1 too large message, but got %d", tooLarge)
+		}
+		return
+	}
+}
+
+func TestCodecMaxMessageSize(t *testing.T) {
+	tlv := TLV{T: 1, L: 9, V: make([]byte, 9)}
+	var b bytes.Buffer
+	c := NewTLVCodec(&b)
+	c.SetMaxMessageSize(8)
+	if err := c.WriteTLV(tlv); err != tooLargeErr {
+		t.Errorf("expect error %v, but got %v", tooLargeErr, err)
+	}
+	if err := NewTLVCodec(&b).WriteTLV(tlv); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadTLV(); err != tooLargeErr {
+		t.Errorf("expect error %v, but got %v", tooLargeErr, err)
+	}
+	// the next message is read after it
+	next := TLV{T: 2, L: 1, V: []byte{3}}
+	if err := NewTLVCodec(&b).WriteTLV(next); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.ReadTLV(); err != nil || !reflect.DeepEqual(got, next) {
+		t.Errorf("expect %#v, but got %#v, %v", next, got, err)
+	}
+
+	// each server has its own limit
+	s1, err := NewServer("", "", "", WithMaxMessageSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.cancel()
+	s2, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.cancel()
+	conn, _ := net.Pipe()
+	if got := s1.newCodec(conn).maxSize; got != 8 {
+		t.Errorf("expect max size 8, but got %d", got)
+	}
+	if got := s2.newCodec(conn).maxSize; got != DefaultMaxMessageSize {
+		t.Errorf("expect max size %d, but got %d", DefaultMaxMessageSize, got)
+	}
+	if _, err = NewServer("", "", "", WithMaxMessageSize(0)); err != badMaxSizeErr {
+		t.Errorf("expect error %v, but got %v", badMaxSizeErr, err)
+	}
+}
+
+// countingConn counts the reads and writes reaching the connection.
+type countingConn struct {
+	msg    []byte
+	off    int
+	reads  int
+	writes int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	c.reads++
+	n := 0
+	for n < len(b) {
+		m := copy(b[n:], c.msg[c.off:])
+		n += m
+		c.off = (c.off + m) % len(c.msg)
+	}
+	return n, nil
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+var benchTLV = TLV{T: tTask, L: 512, V: make([]byte, 512)}
+
+func benchConn(b *testing.B) *countingConn {
+	var buf bytes.Buffer
+	if err := WriteTLV(&buf, benchTLV); err != nil {
+		b.Fatal(err)
+	}
+	return &countingConn{msg: buf.Bytes()}
+}
+
+func BenchmarkWriteTLV(b *testing.B) {
+	c := benchConn(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		WriteTLV(c, benchTLV)
+	}
+	b.ReportMetric(float64(c.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkCodecWriteTLV(b *testing.B) {
+	c := benchConn(b)
+	codec := NewTLVCodec(c)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		codec.WriteTLV(benchTLV)
+	}
+	b.ReportMetric(float64(c.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkReadTLV(b *testing.B) {
+	c := benchConn(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ReadTLV(c)
+	}
+	b.ReportMetric(float64(c.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkCodecReadTLV(b *testing.B) {
+	c := benchConn(b)
+	codec := NewTLVCodec(c)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tlv, _ := codec.ReadTLV()
+		ReleaseTLV(tlv)
+	}
+	b.ReportMetric(float64(c.reads)/float64(b.N), "reads/op")
+}
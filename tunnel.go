@@ -2,69 +2,150 @@ package proxy_server
 
 import (
 	"io"
-	"log"
 	"net"
 )
 
 const (
-	tCreateSSConnect = 1
-	tTaskRecv        = 2
-	tTask            = 3
-	tPing            = 4
+	tCreateSSConnect    = 1
+	tTaskRecv           = 2
+	tTask               = 3
+	tPing               = 4
+	tCreateSSUDPConnect = 5
+	tFeatures           = 8
+	tTaskID             = 9
+	tTaskRecvID         = 10
+	tTaskAck            = 11
 )
 
 func GetCtrRequest(r io.Reader) (*Request, error) {
-	tlv, err := ReadTLV(r)
+	return getCtrRequest(tunnelLog, r)
+}
+
+func getCtrRequest(l Logger, r io.Reader) (*Request, error) {
+	tlv, err := readMessage(l, r)
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[tunnel]: read control request failed: %s\n", err)
+			l.Error("read control request failed", "err", err)
 		}
 		return nil, err
 	}
+	countTLV("tunnel", "in", tlv.T)
 
 	switch tlv.T {
 	case tCreateSSConnect:
+		defer ReleaseTLV(tlv)
 		return &Request{
 			Typ:       CreateSSConnect,
 			SocketKey: string(tlv.V),
 		}, nil
+	case tCreateSSUDPConnect:
+		defer ReleaseTLV(tlv)
+		return &Request{
+			Typ:       CreateSSUDPConnect,
+			SocketKey: string(tlv.V),
+		}, nil
 	case tTask:
 		return &Request{
 			Typ:      TaskResult,
 			TaskData: tlv.V,
 		}, nil
+	case tTaskID:
+		id, data, err := parseTaskID(l, tlv.V)
+		if err != nil {
+			return nil, err
+		}
+		return &Request{
+			Typ:      TaskResult,
+			TaskID:   id,
+			TaskData: data,
+		}, nil
+	case tTaskAck:
+		id, _, err := parseTaskID(l, tlv.V)
+		ReleaseTLV(tlv)
+		if err != nil {
+			return nil, err
+		}
+		return &Request{
+			Typ:    TaskAck,
+			TaskID: id,
+		}, nil
 	case tPing:
+		seq, err := parsePing(l, tlv.V)
+		ReleaseTLV(tlv)
+		if err != nil {
+			return nil, err
+		}
+		return &Request{
+			Typ:     Ping,
+			PingSeq: seq,
+		}, nil
+	case tFeatures:
+		f, err := unmarshalFeatures(l, tlv.V)
+		ReleaseTLV(tlv)
+		if err != nil {
+			return nil, err
+		}
 		return &Request{
-			Typ: Ping,
+			Typ:      TunnelFeatures,
+			Features: f,
 		}, nil
 	default:
-		log.Printf("[tunnel]: unknown command type[%#x]\n", tlv.T)
+		l.Error("unknown command type", "type", tlv.T)
 		return nil, unknownTypeErr
 	}
 }
 
-func PutCtrRequest(w io.Writer, req *Request) error {
+// PutCtrRequest writes req to a peer speaking f, the request types it
+// doesn't support are refused.
+func PutCtrRequest(w io.Writer, req *Request, f Features) error {
+	tlv, err := encodeCtrRequest(tunnelLog, req, f)
+	if err != nil {
+		return err
+	}
+
+	err = WriteTLV(w, tlv)
+	if err != nil {
+		tunnelLog.Error("write control request failed", "request", req.Typ, "err", err)
+	}
+	return err
+}
+
+// encodeCtrRequest returns the message of req for a peer speaking f.
+func encodeCtrRequest(l Logger, req *Request, f Features) (TLV, error) {
 	var tlv TLV
 	switch req.Typ {
 	case PushTaskRecv:
 		tlv.T = tTaskRecv
 		tlv.V = req.TaskData
+		if req.TaskID != 0 && f.Has(CapTaskID) {
+			tlv.T = tTaskRecvID
+			tlv.V = taskMessage(req.TaskID, req.TaskData)
+		}
 	case PushTask:
 		tlv.T = tTask
 		tlv.V = req.TaskData
+		if req.TaskID != 0 && f.Has(CapTaskID) {
+			tlv.T = tTaskID
+			tlv.V = taskMessage(req.TaskID, req.TaskData)
+		}
 	case Ping:
 		tlv.T = tPing
+		if req.PingSeq != 0 && f.Has(CapPingStats) {
+			tlv.V = pingMessage(req.PingSeq, req.PingSent)
+		}
+	case TunnelFeatures:
+		tlv.T = tFeatures
+		tlv.V = req.Features.marshal()
 	default:
-		log.Printf("[tunnel]: unknown type[%#x]\n", req.Typ)
-		return unknownTypeErr
+		l.Error("unknown request type", "request", req.Typ)
+		return tlv, unknownTypeErr
 	}
-	tlv.L = uint16(len(tlv.V))
-
-	err := WriteTLV(w, tlv)
-	if err != nil {
-		log.Printf("[tunnel]: write control request[%#v] failed: %s\n",
-			req, err)
+	if err := fitsPeer(len(tlv.V), f); err != nil {
+		l.Error("request is too large for peer", "request", req.Typ, "len", len(tlv.V))
+		return tlv, err
 	}
-	return err
+	tlv.L = uint32(len(tlv.V))
+
+	return tlv, nil
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetCtrRequest(t *testing.T) {
@@ -27,6 +28,13 @@ func TestGetCtrRequest(t *testing.T) {
 				SocketKey: "tw",
 			},
 		},
+		"CreateSSUDPConnect": {
+			data: []byte{0, 5, 0, 2, 0x74, 0x77},
+			expect: &Request{
+				Typ:       CreateSSUDPConnect,
+				SocketKey: "tw",
+			},
+		},
 		"TaskResult": {
 			data: []byte{0, 3, 0, 2, 0x74, 0x77},
 			expect: &Request{
@@ -34,12 +42,49 @@ func TestGetCtrRequest(t *testing.T) {
 				TaskData: []byte{0x74, 0x77},
 			},
 		},
+		"TaskResultID": {
+			data: []byte{0, 9, 0, 6, 0, 0, 0, 1, 0x74, 0x77},
+			expect: &Request{
+				Typ:      TaskResult,
+				TaskID:   1,
+				TaskData: []byte{0x74, 0x77},
+			},
+		},
+		"TaskAck": {
+			data: []byte{0, 11, 0, 4, 0, 0, 0, 3},
+			expect: &Request{
+				Typ:    TaskAck,
+				TaskID: 3,
+			},
+		},
+		"TaskAckShort": {
+			data:      []byte{0, 11, 0, 2, 0, 3},
+			expectErr: true,
+		},
 		"Ping": {
 			data: []byte{0, 4, 0, 0},
 			expect: &Request{
 				Typ: Ping,
 			},
 		},
+		"PingSeq": {
+			data: []byte{0, 4, 0, 12, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 3},
+			expect: &Request{
+				Typ:     Ping,
+				PingSeq: 2,
+			},
+		},
+		"PingShort": {
+			data:      []byte{0, 4, 0, 2, 0, 2},
+			expectErr: true,
+		},
+		"Features": {
+			data: []byte{0, 8, 0, 6, 0, 1, 0, 0, 0, 1},
+			expect: &Request{
+				Typ:      TunnelFeatures,
+				Features: Features{Version: 1, Caps: CapServerShutdown},
+			},
+		},
 	} {
 		c := c
 		t.Run(name, func(t *testing.T) {
@@ -58,14 +103,22 @@ func TestGetCtrRequest(t *testing.T) {
 
 func TestPutCtrRequest(t *testing.T) {
 	for name, c := range map[string]struct {
-		req    *Request
-		err    error
-		expect []byte
+		req      *Request
+		features Features
+		err      error
+		expect   []byte
 	}{
 		"unknownType": {
 			req: &Request{Typ: 0xdead},
 			err: unknownTypeErr,
 		},
+		"largeLegacy": {
+			req: &Request{
+				Typ:      PushTask,
+				TaskData: make([]byte, maxShortLen+1),
+			},
+			err: unsupportedErr,
+		},
 		"PushTask": {
 			req: &Request{
 				Typ:      PushTask,
@@ -73,6 +126,23 @@ func TestPutCtrRequest(t *testing.T) {
 			},
 			expect: []byte{0, 3, 0, 3, 1, 2, 3},
 		},
+		"PushTaskID": {
+			req: &Request{
+				Typ:      PushTask,
+				TaskID:   2,
+				TaskData: []byte{1},
+			},
+			features: Features{Version: 1, Caps: CapTaskID},
+			expect:   []byte{0, 9, 0, 5, 0, 0, 0, 2, 1},
+		},
+		"PushTaskIDLegacy": {
+			req: &Request{
+				Typ:      PushTask,
+				TaskID:   2,
+				TaskData: []byte{1},
+			},
+			expect: []byte{0, 3, 0, 1, 1},
+		},
 		"PushTaskRecv": {
 			req: &Request{
 				Typ:      PushTaskRecv,
@@ -86,13 +156,36 @@ func TestPutCtrRequest(t *testing.T) {
 			},
 			expect: []byte{0, 4, 0, 0},
 		},
+		"PingSeq": {
+			req: &Request{
+				Typ:      Ping,
+				PingSeq:  2,
+				PingSent: time.Unix(0, 3),
+			},
+			features: Features{Version: 1, Caps: CapPingStats},
+			expect:   []byte{0, 4, 0, 12, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 3},
+		},
+		"PingSeqLegacy": {
+			req: &Request{
+				Typ:     Ping,
+				PingSeq: 2,
+			},
+			expect: []byte{0, 4, 0, 0},
+		},
+		"Features": {
+			req: &Request{
+				Typ:      TunnelFeatures,
+				Features: Features{Version: 1},
+			},
+			expect: []byte{0, 8, 0, 6, 0, 1, 0, 0, 0, 0},
+		},
 	} {
 		c := c
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
 			var b bytes.Buffer
-			err := PutCtrRequest(&b, c.req)
+			err := PutCtrRequest(&b, c.req, c.features)
 			if err != c.err {
 				t.Errorf("expect error %v, but got %v", c.err, err)
 			}
@@ -0,0 +1,323 @@
+package proxy_server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// udp packets are carried over the data connection one after another,
+// each one is framed as:
+// 2(length, big endian) + shadowsocks udp packet(address + payload)
+// replies come back with the same framing, their address is the one of
+// the remote peer.
+
+var (
+	udpTimeout = 60 * time.Second
+
+	shortPacketErr = errors.New("udp packet is too short")
+)
+
+const maxUDPPacketSize = 65535
+
+func (s *srv) HandleSSUDPConnectRequest(clientAddr, key string) {
+	l := s.logger("udp").With("conn", nextConnID(), "key", key)
+	l.Debug("handle ss udp connection request", "client", clientAddr)
+	if s.isClosing() {
+		l.Debug("server is shutting down, drop request")
+		return
+	}
+	conn, err := makeSSTunnel(l, clientAddr, key, s.dataTLS)
+	if err != nil {
+		l.Error("make tunnel failed", "err", err)
+		return
+	}
+	if !s.addConn(conn) {
+		conn.Close()
+		return
+	}
+	defer s.removeConn(conn)
+
+	p := sessionPolicy{acl: s.acl, resolver: s.resolver, timeouts: s.timeouts}
+	p.up, p.down = s.limiter.acquire(key)
+	defer s.limiter.release(key)
+
+	rec := handleSSUDPConnection(l, s.cipher.newConn(conn), p)
+	rec.Key = key
+	s.recordSession(*rec)
+}
+
+// handleSSUDPConnection relays the packets of conn under p until it is
+// closed, the record has no target as the packets go to any.
+func handleSSUDPConnection(l Logger, conn net.Conn, p sessionPolicy) *SessionRecord {
+	l = l.With("local", conn.LocalAddr(), "client", conn.RemoteAddr())
+	l.Debug("new client")
+
+	rec := &SessionRecord{Start: time.Now()}
+	st := newSessionTimer(p.timeouts, conn)
+	r := newUDPRelay(l, conn, p, st)
+	err := r.serve()
+	rec.End = time.Now()
+	rec.BytesUp, rec.BytesDown = atomic.LoadInt64(&r.up), atomic.LoadInt64(&r.down)
+	rec.Reason = closeReason(err, false)
+	if reason, ok := st.stop(); ok {
+		rec.Reason, err = reason, nil
+	}
+	if err != nil && rec.Reason != CloseEOF {
+		rec.Err = err.Error()
+	}
+	if rec.Reason.timeout() {
+		sessionTimeouts.add(1, "cause", rec.Reason.String())
+	}
+	l.Debug("client done", "up", rec.BytesUp, "down", rec.BytesDown, "reason", rec.Reason)
+	return rec
+}
+
+type natEntry struct {
+	conn       net.Conn
+	header     []byte
+	lastActive int64 // unix nano
+}
+
+func (e *natEntry) touch() {
+	atomic.StoreInt64(&e.lastActive, time.Now().UnixNano())
+}
+
+func (e *natEntry) idle(now time.Time) bool {
+	last := time.Unix(0, atomic.LoadInt64(&e.lastActive))
+	return !now.Before(last.Add(udpTimeout))
+}
+
+// udpRelay forwards the udp packets received on a data connection to
+// their targets, it keeps a nat table from target address to the
+// outbound socket, idle entries are expired after udpTimeout. The
+// targets are dialed by the policy of the session, which also shapes
+// and times the packets both ways.
+type udpRelay struct {
+	log    Logger
+	conn   net.Conn
+	policy sessionPolicy
+	st     *sessionTimer
+	wlock  sync.Mutex
+	lock   sync.Mutex
+	nat    map[string]*natEntry
+	waiter sync.WaitGroup
+
+	// bytes of the payloads relayed to the targets and back
+	up, down int64
+}
+
+func newUDPRelay(l Logger, conn net.Conn, p sessionPolicy, st *sessionTimer) *udpRelay {
+	return &udpRelay{
+		log:    l,
+		conn:   conn,
+		policy: p,
+		st:     st,
+		nat:    make(map[string]*natEntry),
+	}
+}
+
+// serve relays the packets of the data connection until it fails, the
+// error is returned.
+func (r *udpRelay) serve() error {
+	defer r.close()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		r.st.beforeRead(r.conn)
+		pkt, err := readUDPPacket(r.conn, buf)
+		if err != nil {
+			r.log.Debug("read packet failed", "err", err)
+			return err
+		}
+		r.st.touch()
+		host, n, err := parseSSAddr(pkt)
+		if err != nil {
+			r.log.Error("parse packet failed", "err", err)
+			continue
+		}
+		r.forward(host, pkt[:n], pkt[n:])
+	}
+}
+
+// forward is only called by serve, so that an entry is only added by
+// it, the target is dialed out of lock.
+func (r *udpRelay) forward(host string, header, payload []byte) {
+	r.lock.Lock()
+	e, ok := r.nat[host]
+	r.lock.Unlock()
+	if !ok {
+		l := r.log.With("target", host)
+		conn, err := dialTarget(l, r.policy, "udp", host)
+		if err == aclDeniedErr {
+			return
+		}
+		if err != nil {
+			countDialErr(host, err)
+			l.Error("connect failed", "err", err)
+			return
+		}
+		e = &natEntry{
+			conn:   conn,
+			header: append([]byte(nil), header...),
+		}
+		e.touch()
+		r.lock.Lock()
+		r.nat[host] = e
+		r.lock.Unlock()
+		r.waiter.Add(1)
+		go r.recv(host, e)
+		l.Debug("new nat entry", "local", conn.LocalAddr())
+	}
+
+	e.touch()
+	r.policy.up.wait(len(payload))
+	n, err := e.conn.Write(payload)
+	atomic.AddInt64(&r.up, int64(n))
+	pipedBytes.add(float64(n))
+	if err != nil {
+		r.log.Error("write failed", "target", host, "err", err)
+	}
+}
+
+func (r *udpRelay) recv(host string, e *natEntry) {
+	defer func() {
+		r.remove(host, e)
+		r.waiter.Done()
+	}()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		e.conn.SetReadDeadline(time.Now().Add(udpTimeout))
+		n, err := e.conn.Read(buf)
+		if err != nil {
+			ne, ok := err.(net.Error)
+			if ok && ne.Timeout() && !e.idle(time.Now()) {
+				continue
+			}
+			r.log.Debug("nat entry done", "target", host, "err", err)
+			return
+		}
+		e.touch()
+		r.st.touch()
+
+		r.policy.down.wait(n)
+		r.wlock.Lock()
+		err = writeUDPPacket(r.conn, e.header, buf[:n])
+		r.wlock.Unlock()
+		if err != nil {
+			r.log.Error("write reply failed", "target", host, "err", err)
+			return
+		}
+		atomic.AddInt64(&r.down, int64(n))
+		pipedBytes.add(float64(n))
+	}
+}
+
+func (r *udpRelay) remove(host string, e *natEntry) {
+	r.lock.Lock()
+	if r.nat[host] == e {
+		delete(r.nat, host)
+	}
+	r.lock.Unlock()
+	e.conn.Close()
+}
+
+func (r *udpRelay) len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.nat)
+}
+
+func (r *udpRelay) close() {
+	r.conn.Close()
+
+	r.lock.Lock()
+	for _, e := range r.nat {
+		e.conn.Close()
+	}
+	r.lock.Unlock()
+
+	r.waiter.Wait()
+}
+
+func readUDPPacket(r io.Reader, buf []byte) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n > len(buf) {
+		return nil, fmt.Errorf("udp packet length %d exceeds %d", n, len(buf))
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func writeUDPPacket(w io.Writer, header, payload []byte) error {
+	n := len(header) + len(payload)
+	if n > maxUDPPacketSize {
+		return fmt.Errorf("udp packet length %d exceeds %d", n, maxUDPPacketSize)
+	}
+	b := make([]byte, 2+n)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	copy(b[2:], header)
+	copy(b[2+len(header):], payload)
+	_, err := w.Write(b)
+	return err
+}
+
+// ssAddrLen returns the length of the shadowsocks address at the
+// beginning of b, which holds its type and the length of a domain.
+func ssAddrLen(b []byte) (int, error) {
+	if len(b) < idType+1 {
+		return 0, shortPacketErr
+	}
+	switch addrType := b[idType] & ss.AddrMask; addrType {
+	case typeIPv4:
+		return idIP0 + lenIPv4, nil
+	case typeIPv6:
+		return idIP0 + lenIPv6, nil
+	case typeDm:
+		if len(b) < idDmLen+1 {
+			return 0, shortPacketErr
+		}
+		return idDm0 + int(b[idDmLen]) + lenDmBase, nil
+	default:
+		return 0, fmt.Errorf("addr type %d not supported", addrType)
+	}
+}
+
+// parseSSAddr decodes the shadowsocks address at the beginning of b,
+// returns the host and the length of the address.
+func parseSSAddr(b []byte) (host string, n int, err error) {
+	reqEnd, err := ssAddrLen(b)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(b) < reqEnd {
+		return "", 0, shortPacketErr
+	}
+
+	// Return string for typeIP is not most efficient, but browsers (Chrome,
+	// Safari, Firefox) all seems using typeDm exclusively. So this is not a
+	// big problem.
+	switch b[idType] & ss.AddrMask {
+	case typeIPv4, typeIPv6:
+		host = net.IP(b[idIP0 : reqEnd-2]).String()
+	case typeDm:
+		host = string(b[idDm0 : reqEnd-2])
+	}
+	port := binary.BigEndian.Uint16(b[reqEnd-2 : reqEnd])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), reqEnd, nil
+}
@@ -0,0 +1,258 @@
+package proxy_server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func startUDPEcho(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func TestParseSSAddr(t *testing.T) {
+	for name, c := range map[string]struct {
+		input     func() ([]byte, error)
+		shouldErr bool
+		host      string
+	}{
+		"dm": {
+			input: func() ([]byte, error) {
+				return ss.RawAddr("www.test.com:1311")
+			},
+			host: "www.test.com:1311",
+		},
+		"ipv4": {
+			input: func() ([]byte, error) {
+				return translateIpv4("1.1.1.1:1311")
+			},
+			host: "1.1.1.1:1311",
+		},
+		"ipv6": {
+			input: func() ([]byte, error) {
+				return translateIpv6("[fe80::6e0b:84ff:fe6a:5aa9]:1311")
+			},
+			host: "[fe80::6e0b:84ff:fe6a:5aa9]:1311",
+		},
+		"short": {
+			input: func() ([]byte, error) {
+				return []byte{typeDm, 20, 'a'}, nil
+			},
+			shouldErr: true,
+		},
+		"unknownType": {
+			input: func() ([]byte, error) {
+				return []byte{0xf, 0, 0}, nil
+			},
+			shouldErr: true,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b, err := c.input()
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := []byte("payload")
+			host, n, err := parseSSAddr(append(b, payload...))
+			if (err != nil) != c.shouldErr {
+				t.Fatalf("expect error %v, but got %v", c.shouldErr, err)
+			}
+			if c.shouldErr {
+				return
+			}
+			if host != c.host {
+				t.Errorf("expect host[%s], but got[%s]", c.host, host)
+			}
+			if n != len(b) {
+				t.Errorf("expect length %d, but got %d", len(b), n)
+			}
+		})
+	}
+}
+
+func TestUDPRelay(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	c1, c2 := net.Pipe()
+	sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
+	r := newUDPRelay(udpLog, sc1, sessionPolicy{}, nil)
+	done := make(chan struct{})
+	go func() {
+		r.serve()
+		close(done)
+	}()
+
+	header, err := translateIpv4(echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxUDPPacketSize)
+	for _, content := range []string{"hello", "world"} {
+		err = writeUDPPacket(sc2, header, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt, err := readUDPPacket(sc2, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pkt[:len(header)], header) {
+			t.Errorf("expect header %v, but got %v", header, pkt[:len(header)])
+		}
+		if got := string(pkt[len(header):]); got != content {
+			t.Errorf("expect payload[%s], but got[%s]", content, got)
+		}
+	}
+	if n := r.len(); n != 1 {
+		t.Errorf("expect 1 nat entry, but got %d", n)
+	}
+
+	sc2.Close()
+	<-done
+	if n := r.len(); n != 0 {
+		t.Errorf("expect nat table empty after close, but got %d", n)
+	}
+}
+
+func TestUDPRelayExpire(t *testing.T) {
+	old := udpTimeout
+	udpTimeout = 10 * time.Millisecond
+	defer func() { udpTimeout = old }()
+
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	c1, c2 := net.Pipe()
+	sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
+	r := newUDPRelay(udpLog, sc1, sessionPolicy{}, nil)
+	done := make(chan struct{})
+	go func() {
+		r.serve()
+		close(done)
+	}()
+	defer func() {
+		sc2.Close()
+		<-done
+	}()
+
+	header, err := translateIpv4(echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeUDPPacket(sc2, header, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readUDPPacket(sc2, make([]byte, maxUDPPacketSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for r.len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle nat entry is not expired")
+		}
+		time.Sleep(udpTimeout)
+	}
+}
+
+func TestUDPSessionPolicy(t *testing.T) {
+	deny, err := NewACL(DenyPrivateRules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]struct {
+		policy sessionPolicy
+		// the payload is echoed
+		echoed bool
+		reason CloseReason
+		log    string
+	}{
+		"allowed": {echoed: true},
+		"denied":  {policy: sessionPolicy{acl: deny}, log: "target denied"},
+		"lifetime": {
+			policy: sessionPolicy{timeouts: SessionTimeouts{Lifetime: 50 * time.Millisecond}},
+			echoed: true,
+			reason: CloseLifetime,
+		},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			echo := startUDPEcho(t)
+			defer echo.Close()
+
+			var b concurrentBuffer
+			c1, c2 := net.Pipe()
+			sc1, sc2 := ss.NewConn(c1, testCipher()), ss.NewConn(c2, testCipher())
+			defer sc2.Close()
+			done := make(chan *SessionRecord, 1)
+			go func() {
+				done <- handleSSUDPConnection(NewLogger(&b, LevelInfo, TextFormat), sc1, c.policy)
+			}()
+
+			header, err := translateIpv4(echo.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			const payload = "hello"
+			if err = writeUDPPacket(sc2, header, []byte(payload)); err != nil {
+				t.Fatal(err)
+			}
+			if c.echoed {
+				pkt, err := readUDPPacket(sc2, make([]byte, maxUDPPacketSize))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(pkt[len(header):]); got != payload {
+					t.Errorf("expect payload %q, but got %q", payload, got)
+				}
+			}
+			if c.reason == CloseEOF {
+				sc2.Close()
+			}
+
+			var rec *SessionRecord
+			select {
+			case rec = <-done:
+			case <-time.After(time.Second):
+				t.Fatal("session doesn't end")
+			}
+			var expect int64
+			if c.echoed {
+				expect = int64(len(payload))
+			}
+			if rec.BytesUp != expect || rec.BytesDown != expect || rec.Reason != c.reason {
+				t.Errorf("expect %d bytes both ways by %s, but got %d up and %d down by %s",
+					expect, c.reason, rec.BytesUp, rec.BytesDown, rec.Reason)
+			}
+			if !strings.Contains(b.String(), c.log) {
+				t.Errorf("expect %q in %q", c.log, b.String())
+			}
+		})
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 )
@@ -91,7 +91,7 @@ func (w *web) handleOp(op *op) {
 		}
 		ln, err := net.Listen("tcp", ":0")
 		if err != nil {
-			log.Printf("[web]: %s\n", err)
+			webLog.Error("listen failed", "err", err)
 			op.localAddr <- ""
 			op.err <- err
 			return
@@ -102,7 +102,7 @@ func (w *web) handleOp(op *op) {
 				// Wait for a connection.
 				conn, err := ln.Accept()
 				if err != nil {
-					log.Printf("[web]: %s\n", err)
+					webLog.Error("accept failed", "err", err)
 					return
 				}
 				// Handle the connection in a new goroutine.
@@ -128,7 +128,7 @@ func (w *web) handleOp(op *op) {
 		}
 		return
 	default:
-		log.Printf("[web]: unknown cmd %#x\n", op.cmd)
+		webLog.Error("unknown cmd", "cmd", op.cmd)
 		return
 	}
 }
@@ -138,11 +138,10 @@ func handleClientMsg(c net.Conn) {
 	for {
 		tlv, err := ReadTLV(c)
 		if err != nil {
-			log.Printf("[web]: %s\n", err)
+			webLog.Error("read client msg failed", "err", err)
 			return
 		}
-		Debug.Printf("[web]: get client msg, t[%#x], l[%d], v[%v]\n",
-			tlv.T, tlv.L, tlv.V)
+		webLog.Debug("get client msg", "tlv", tlv)
 	}
 }
 
@@ -157,18 +156,17 @@ func getVmAddresses() (vmConfig, vmData string, err error) {
 	post := func(url string, body []byte) ([]byte, error) {
 		resp, err := http.Post(url, "", bytes.NewReader(body))
 		if err != nil {
-			log.Printf("[web]: post [%s] failed: %s\n", url, err)
+			webLog.Error("post failed", "url", url, "err", err)
 			return nil, err
 		}
 
 		body, err = ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			log.Printf("[web]: ReadAll failed: %s\n", err)
+			webLog.Error("read response failed", "url", url, "err", err)
 			return nil, err
 		}
-		Debug.Printf("[web]: post[%s] return : StatusCode[%d], body[%s]\n",
-			url, resp.StatusCode, string(body))
+		webLog.Debug("post returns", "url", url, "status", resp.StatusCode, "body", string(body))
 		return body, nil
 	}
 
@@ -194,10 +192,10 @@ func getVmAddresses() (vmConfig, vmData string, err error) {
 	var s sys
 	err = json.Unmarshal(body, &s)
 	if err != nil {
-		log.Printf("[web]: %s\n", err)
+		webLog.Error("unmarshal system info failed", "err", err)
 		return
 	}
-	Debug.Printf("[web]: system info: %#v\n", s)
+	webLog.Debug("system info", "info", fmt.Sprintf("%+v", s))
 
 	// report device info
 	type devinfo struct {
@@ -247,7 +245,7 @@ func getVmAddresses() (vmConfig, vmData string, err error) {
 	url := s.Infos[0].Url + "/ReportDevInfo.action"
 	body, err = json.Marshal(di)
 	if err != nil {
-		log.Printf("[web]: %s\n", err)
+		webLog.Error("marshal device info failed", "err", err)
 		return
 	}
 	body, err = post(url, body)
@@ -263,7 +261,7 @@ func getVmAddresses() (vmConfig, vmData string, err error) {
 		IMEI: IMEI,
 	})
 	if err != nil {
-		log.Printf("[web]: %s\n", err)
+		webLog.Error("marshal vm platform request failed", "err", err)
 		return
 	}
 	body, err = post(url, body)
@@ -277,10 +275,10 @@ func getVmAddresses() (vmConfig, vmData string, err error) {
 	}{}
 	err = json.Unmarshal(body, &vmPlat)
 	if err != nil {
-		log.Printf("[web]: %s\n", err)
+		webLog.Error("unmarshal vm platform info failed", "err", err)
 		return
 	}
-	Debug.Printf("[web]: vm platform info: %#v\n", vmPlat)
+	webLog.Debug("vm platform info", "info", fmt.Sprintf("%+v", vmPlat))
 	if vmPlat.Code != "200" {
 		err = errors.New("failed to get vm platform info")
 		return
@@ -307,10 +305,10 @@ func getVmAddresses() (vmConfig, vmData string, err error) {
 	}{}
 	err = json.Unmarshal(body, &vm)
 	if err != nil {
-		log.Printf("[web]: %s\n", err)
+		webLog.Error("unmarshal vm info failed", "err", err)
 		return
 	}
-	Debug.Printf("[web]: vm info: %#v\n", vm)
+	webLog.Debug("vm info", "info", fmt.Sprintf("%+v", vm))
 	if vm.Code != "200" {
 		err = errors.New("failed to get vm info")
 		return
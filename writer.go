@@ -0,0 +1,128 @@
+package proxy_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// QueuePolicy tells what happens to a message when the outbound queue
+// of a link is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock makes the sender wait for room in the queue.
+	QueueBlock QueuePolicy = iota
+	// QueueDrop drops the message.
+	QueueDrop
+)
+
+var (
+	defaultQueueSize = 64
+	writeTimeout     = 10 * time.Second
+
+	queueFullErr    = errors.New("outbound queue is full")
+	writerClosedErr = errors.New("link writer is closed")
+	invalidQueueErr = errors.New("invalid outbound queue")
+)
+
+// WithOutboundQueue sets the size of the outbound queue of both links
+// and what to do once it is full, the default is 64 messages with
+// QueueBlock.
+func WithOutboundQueue(size int, policy QueuePolicy) ServerOption {
+	return func(s *srv) error {
+		if size <= 0 || (policy != QueueBlock && policy != QueueDrop) {
+			return invalidQueueErr
+		}
+		s.queueSize = size
+		s.queuePolicy = policy
+		return nil
+	}
+}
+
+// linkWriter is the only writer of a link, the messages are written in
+// the order they are queued.
+type linkWriter struct {
+	name   string
+	ctx    context.Context
+	conn   net.Conn
+	codec  *TLVCodec
+	queue  chan TLV
+	policy QueuePolicy
+	// bounds each write, writeTimeout once the writer is made
+	timeout time.Duration
+	// closed once the writer stops
+	done chan struct{}
+	log  Logger
+}
+
+func newLinkWriter(ctx context.Context, name string, conn net.Conn, codec *TLVCodec,
+	size int, policy QueuePolicy, l Logger) *linkWriter {
+	return &linkWriter{
+		name:    name,
+		ctx:     ctx,
+		conn:    conn,
+		codec:   codec,
+		queue:   make(chan TLV, size),
+		policy:  policy,
+		timeout: writeTimeout,
+		done:    make(chan struct{}),
+		log:     l,
+	}
+}
+
+// run writes the queued messages until ctx is done or a write fails,
+// the failure is reported to errc.
+func (w *linkWriter) run(errc chan<- error) {
+	defer w.log.Debug("writer exits", "link", w.name)
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			close(w.done)
+			return
+		case tlv := <-w.queue:
+			err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+			if err == nil {
+				err = w.codec.WriteTLV(tlv)
+			}
+			if err != nil {
+				w.log.Error("write message failed", "link", w.name, "type", tlv.T, "err", err)
+				close(w.done)
+				select {
+				case errc <- err:
+				case <-w.ctx.Done():
+				}
+				return
+			}
+			countTLV(w.name, "out", tlv.T)
+		}
+	}
+}
+
+// put queues tlv, it fails once the writer stops.
+func (w *linkWriter) put(tlv TLV) error {
+	select {
+	case <-w.done:
+		return writerClosedErr
+	default:
+	}
+
+	if w.policy == QueueDrop {
+		select {
+		case w.queue <- tlv:
+			return nil
+		default:
+			w.log.Error("queue is full, drop message", "link", w.name, "type", tlv.T)
+			return queueFullErr
+		}
+	}
+
+	select {
+	case w.queue <- tlv:
+		return nil
+	case <-w.done:
+		return writerClosedErr
+	}
+}
@@ -0,0 +1,99 @@
+package proxy_server
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestLinkWriterOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, w := net.Pipe()
+	defer r.Close()
+
+	out := newLinkWriter(ctx, "test", w, NewTLVCodec(w), 4, QueueBlock, defaultLogger())
+	errc := make(chan error, 1)
+	go out.run(errc)
+
+	const count = 32
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := out.put(TLV{T: uint16(i), L: 0, V: []byte{}}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < count; i++ {
+		tlv, err := ReadTLV(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlv.T != uint16(i) {
+			t.Fatalf("expect message %d, but got %d", i, tlv.T)
+		}
+	}
+}
+
+func TestLinkWriterDrop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, w := net.Pipe()
+	defer r.Close()
+
+	// nobody reads, the writer is stuck with the first message
+	out := newLinkWriter(ctx, "test", w, NewTLVCodec(w), 1, QueueDrop, defaultLogger())
+	errc := make(chan error, 1)
+	go out.run(errc)
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = out.put(TLV{T: 1, L: 0, V: []byte{}})
+	}
+	if err != queueFullErr {
+		t.Errorf("expect error %v, but got %v", queueFullErr, err)
+	}
+}
+
+func TestLinkWriterFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, w := net.Pipe()
+	r.Close()
+
+	out := newLinkWriter(ctx, "test", w, NewTLVCodec(w), 1, QueueBlock, defaultLogger())
+	errc := make(chan error, 1)
+	go out.run(errc)
+
+	if err := out.put(TLV{T: 1, L: 0, V: []byte{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("write failure should be reported")
+	}
+	if err := out.put(TLV{T: 1, L: 0, V: []byte{}}); err != writerClosedErr {
+		t.Errorf("expect error %v, but got %v", writerClosedErr, err)
+	}
+}
+
+func TestWithOutboundQueue(t *testing.T) {
+	for name, c := range map[string]struct {
+		size      int
+		policy    QueuePolicy
+		shouldErr bool
+	}{
+		"block":         {size: 1, policy: QueueBlock},
+		"drop":          {size: 16, policy: QueueDrop},
+		"zeroSize":      {size: 0, policy: QueueBlock, shouldErr: true},
+		"unknownPolicy": {size: 1, policy: 3, shouldErr: true},
+	} {
+		s, err := NewServer("", "", "", WithOutboundQueue(c.size, c.policy))
+		if (err != nil) != c.shouldErr {
+			t.Errorf("%s: expect error %v, but got %v", name, c.shouldErr, err)
+		}
+		if s != nil {
+			s.cancel()
+		}
+	}
+}